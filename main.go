@@ -9,42 +9,89 @@ package main
 import (
 	"bufio"
 	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
+	"log/syslog"
 	"net"
 	"net/http"
 	"net/url"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
+	"unicode/utf8"
 
 	"github.com/charmbracelet/bubbles/spinner"
+	"github.com/charmbracelet/bubbles/viewport"
 	tea "github.com/charmbracelet/bubbletea"
 	"github.com/charmbracelet/lipgloss"
+	"github.com/muesli/termenv"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
 )
 
 type Stage string
 type Status string
 
 const (
-	StageDNSCheck    Stage = "dns_check"
-	StageRepoNet     Stage = "repo_network_check"
-	StageDetectEnv   Stage = "detect_env"
-	StageClearCache  Stage = "clear_repo_cache"
-	StagePkgUpdate   Stage = "pkg_update_force"
-	StagePkgCheckDA  Stage = "pkg_check_da"
-	StagePkgRecompute Stage = "pkg_check_recompute"
-	StageMoveLocalDB Stage = "move_local_sqlite"
-	StageComplete    Stage = "complete"
+	StageDNSCheck      Stage = "dns_check"
+	StageRepoNet       Stage = "repo_network_check"
+	StageDetectEnv     Stage = "detect_env"
+	StagePkgLock       Stage = "pkg_lock"
+	StageVerifyPkgSelf Stage = "verify_pkg_self"
+	StageKeysPerms     Stage = "pkg_keys_perms"
+	StageABIMatch      Stage = "abi_match"
+	StageSystemFacts   Stage = "system_facts"
+	StageCatalogSize   Stage = "catalog_size"
+	StageClearCache    Stage = "clear_repo_cache"
+	StagePkgClean      Stage = "pkg_clean"
+	StagePkgUpdate     Stage = "pkg_update_force"
+	StagePkgCheckDA    Stage = "pkg_check_da"
+	StagePkgRecompute  Stage = "pkg_check_recompute"
+	StagePkgRecheckDA  Stage = "pkg_recheck_da"
+	StageMoveLocalDB   Stage = "move_local_sqlite"
+	StagePkgUpgrade    Stage = "pkg_upgrade"
+	StagePkgAudit      Stage = "pkg_audit"
+	StageStatsBefore   Stage = "pkg_stats_before"
+	StageStatsAfter    Stage = "pkg_stats_after"
+	StageSmokeTest     Stage = "smoke_test"
+	StageVerifyCmd     Stage = "verify_cmd"
+	StagePreHook       Stage = "pre_hook"
+	StagePostHook      Stage = "post_hook"
+	StageRestore       Stage = "restore_local_sqlite"
+	StageSetBranch     Stage = "set_branch"
+	StageComplete      Stage = "complete"
 
 	StatusOK    Status = "ok"
 	StatusSkip  Status = "skip"
 	StatusWarn  Status = "warn"
 	StatusError Status = "error"
+	StatusInfo  Status = "info"
+)
+
+// SkipReason explains, machine-readably, why a stage reported StatusSkip.
+type SkipReason string
+
+const (
+	SkipUserExcluded  SkipReason = "user_excluded"
+	SkipOffline       SkipReason = "offline"
+	SkipDependency    SkipReason = "dependency_not_met"
+	SkipDryRun        SkipReason = "dry_run"
+	SkipNotApplicable SkipReason = "not_applicable"
 )
 
 const appTitle = "ppr · PGSD pkg repair"
@@ -55,23 +102,135 @@ var appLabel = []string{
 }
 
 type Event struct {
-	Time    string `json:"time"`
-	Stage   Stage  `json:"stage"`
-	Status  Status `json:"status"`
-	Message string `json:"message"`
-	Detail  string `json:"detail,omitempty"`
+	Time    string         `json:"time"`
+	Stage   Stage          `json:"stage"`
+	Status  Status         `json:"status"`
+	Message string         `json:"message"`
+	Detail  string         `json:"detail,omitempty"`
+	Data    map[string]any `json:"data,omitempty"`
+	// SkipReason is set on every StatusSkip event.
+	SkipReason SkipReason `json:"skip_reason,omitempty"`
+	// Attempts is how many tries the stage needed (1 unless it retried).
+	Attempts int    `json:"attempts"`
+	Start    string `json:"start,omitempty"`
+	End      string `json:"end,omitempty"`
+	// DurationMs is how long the stage ran, from dispatch to result.
+	DurationMs int64 `json:"duration_ms"`
+	// ExitCode is the exit status of the stage's command, when it ran one.
+	ExitCode *int `json:"exit_code,omitempty"`
 }
 
+// timestampMs is the layout of Event.Start and Event.End, which together
+// form the run's timeline.
+const timestampMs = "2006-01-02T15:04:05.000Z07:00"
+
 type Config struct {
 	DryRun     bool
 	Compact    bool
 	JSONReport string
 	Timeout    time.Duration
+	// StageTimeout caps each stage; Timeout is the deadline of the run.
+	StageTimeout time.Duration
+	SlowMirror   time.Duration
+	Suggest      bool
+	LockWait     bool
+	RepoRegex    *regexp.Regexp
+	Facts        bool
+	NoColor      bool
+	ForceColor   bool
+	Checksum     bool
+	NoSpinner    bool
+	RunRetries   int
+	Attempt      int
+	RepoConf     string
+	EditConfig   bool
+	CatalogSize  bool
+	Offline      bool
+	Anonymize    bool
+	CacheGlobs   []string
+	VerifyCmd    string
+	SyslogAddr   string
+	Syslog       *syslog.Writer
+	// NDJSON is the --report-ndjson file, opened by main for appending.
+	NDJSON      *os.File
+	ColorDepth  string
+	Timeline    bool
+	ProbeViaPkg bool
+	// ProbeRetries is how many more times a failed mirror probe is tried.
+	ProbeRetries int
+	// DeepCheck also looks for each mirror's catalog archives.
+	DeepCheck   bool
+	DNSSeverity Status
+	Format      string
+	ReportDir   string
+	Repeat      time.Duration
+	History     []string // summaries of earlier --repeat runs
+	CheckOnly   bool
+	Plain       bool
+	Strict      bool
+	// MachineSummary prints a one-line key=value summary to stderr.
+	MachineSummary bool
+	// OnComplete is what happens when a run ends: quit, wait for a
+	// keypress, or repeat after the --repeat interval.
+	OnComplete string
+	// Restore replaces the pipeline with StageRestore; Force lets it
+	// overwrite an existing local.sqlite.
+	Restore bool
+	Force   bool
+	// Yes answers the local.sqlite confirmation prompt in advance.
+	Yes bool
+	// Remote is the user@host[:port] that --remote repairs over SSH.
+	Remote string
+	// SmokePkg is the package StageSmokeTest looks up in the remote
+	// catalog; empty disables the stage.
+	SmokePkg string
+	// Stages, when set, limits the pipeline to the stages it marks.
+	Stages map[Stage]bool
+	// PreHook and PostHook are shell commands run before the first stage
+	// and after the last. RunStatus is the worst status before the
+	// post-hook, which it receives as PPR_STATUS.
+	PreHook   string
+	PostHook  string
+	RunStatus Status
+	// Upgrade adds StagePkgUpgrade once the database is repaired.
+	Upgrade bool
+	// Clean adds StagePkgClean after the repo cache is cleared.
+	Clean bool
+	// StatsBefore is the remote package count StageStatsBefore found,
+	// which StageStatsAfter compares against; -1 when unknown.
+	StatsBefore int
+	// SetBranch replaces the pipeline with StageSetBranch, which points
+	// the repo configs at this branch (quarterly or latest).
+	SetBranch string
+	// Audit adds StagePkgAudit; AuditFail makes vulnerabilities it finds
+	// fail the run.
+	Audit     bool
+	AuditFail bool
+}
+
+// Repo is a repository block parsed from pkg -vv.
+type Repo struct {
+	Name string
+	URL  string
+	// Disabled is set for repos configured with enabled: no.
+	Disabled bool
+	// ABIBase is the URL up to where ${ABI} was substituted, and ABI the
+	// value substituted; both are empty for URLs without ${ABI}.
+	ABIBase string
+	ABI     string
 }
 
 type eventMsg Event
 type nextStageMsg struct{}
 type errMsg struct{ err error }
+type editorDoneMsg struct{ err error }
+
+// clockTickMsg redraws the header's elapsed clock under --no-spinner,
+// where no spinner tick does.
+type clockTickMsg struct{}
+
+// confirmMsg pauses the pipeline to ask before running a destructive stage.
+type confirmMsg struct{ stage Stage }
 
 type model struct {
 	cfg     Config
@@ -83,6 +242,52 @@ type model struct {
 	idx     int
 	done    bool
 	err     error
+
+	// editPrompt is the repo config file we are offering to open in
+	// $EDITOR; while set the pipeline is paused.
+	editPrompt string
+
+	// paused holds the pipeline between stages; held records that a
+	// stage finished while paused and the next one is waiting.
+	paused bool
+	held   bool
+	// retrying is set while a held stage is being re-run with r; its
+	// result replaces the stage's earlier event.
+	retrying bool
+
+	// deferred are the repair stages held back by --check-only; fixPrompt
+	// asks whether to run them after the diagnosis.
+	deferred  []Stage
+	fixPrompt bool
+
+	// sinks receive every event as it is recorded and the run summary
+	// at the end.
+	sinks []EventSink
+	// reportErr is why the report could not be written, if it wasn't.
+	reportErr error
+
+	// ctx is the parent of every stage's context; cancel aborts the
+	// stage in flight when the user quits.
+	ctx     context.Context
+	cancel  context.CancelFunc
+	aborted bool
+	// stage lets s cancel the stage in flight. It is a pointer so the
+	// value-receiver methods that dispatch stages can update it.
+	stage *stageCtl
+
+	// vp scrolls the stage list under the fixed banner once the
+	// terminal size is known (ready).
+	vp    viewport.Model
+	ready bool
+
+	// awaitingConfirm holds the pipeline on a y/N prompt before the
+	// last-resort move of local.sqlite.
+	awaitingConfirm bool
+
+	// started and ended bound the run for the header's elapsed clock,
+	// which stops once ended is set.
+	started time.Time
+	ended   time.Time
 }
 
 type styles struct {
@@ -96,7 +301,22 @@ type styles struct {
 	detail  lipgloss.Style
 }
 
-func newStyles() styles {
+// newStyles returns the color palette, or with plain set styles without
+// colors or bold; the status icons carry the meaning on their own.
+func newStyles(plain bool) styles {
+	if plain {
+		s := lipgloss.NewStyle()
+		return styles{
+			title:   s.Align(lipgloss.Center),
+			label:   s.Align(lipgloss.Center),
+			section: s,
+			ok:      s,
+			warn:    s,
+			skipped: s,
+			error:   s,
+			detail:  s,
+		}
+	}
 	blue := lipgloss.Color("#003366")
 	green := lipgloss.Color("#10b981")
 	yellow := lipgloss.Color("#f59e0b")
@@ -114,32 +334,277 @@ func newStyles() styles {
 	}
 }
 
-func initialModel(cfg Config) model {
-	sp := spinner.New()
-	sp.Spinner = spinner.Dot
-	sp.Style = lipgloss.NewStyle().Foreground(lipgloss.Color("#003366"))
+// colorDepths maps --color-depth values to termenv profiles.
+var colorDepths = map[string]termenv.Profile{
+	"truecolor": termenv.TrueColor,
+	"256":       termenv.ANSI256,
+	"16":        termenv.ANSI,
+	"none":      termenv.Ascii,
+}
+
+// configureColor picks the lipgloss color profile. By default it is
+// detected from TERM/COLORTERM/NO_COLOR so minimal recovery consoles get
+// plain text instead of raw escape sequences.
+func configureColor(cfg Config) {
+	switch {
+	case cfg.NoColor:
+		lipgloss.SetColorProfile(termenv.Ascii)
+	case cfg.ColorDepth != "":
+		lipgloss.SetColorProfile(colorDepths[cfg.ColorDepth])
+	case cfg.ForceColor:
+		lipgloss.SetColorProfile(termenv.TrueColor)
+	default:
+		lipgloss.SetColorProfile(termenv.NewOutput(os.Stdout).EnvColorProfile())
+	}
+}
+
+// plainStyles reports whether to drop colors and bold: --no-color, or the
+// NO_COLOR convention (https://no-color.org) unless color was forced.
+func plainStyles(cfg Config) bool {
+	if cfg.NoColor {
+		return true
+	}
+	return os.Getenv("NO_COLOR") != "" && !cfg.ForceColor && cfg.ColorDepth == ""
+}
+
+// pipelineStages are the stage names --only and --skip accept.
+var pipelineStages = []Stage{
+	StagePreHook, StageDNSCheck, StageRepoNet, StageCatalogSize, StageDetectEnv, StagePkgLock,
+	StageVerifyPkgSelf, StageKeysPerms, StageABIMatch, StageSystemFacts, StageStatsBefore,
+	StageClearCache, StagePkgClean, StagePkgUpdate, StagePkgCheckDA, StagePkgRecompute,
+	StagePkgRecheckDA, StageMoveLocalDB, StageStatsAfter, StagePkgUpgrade, StagePkgAudit, StageSmokeTest, StageVerifyCmd, StagePostHook,
+}
+
+// parseStageList parses a comma-separated list of stage names.
+func parseStageList(list string) (map[Stage]bool, error) {
+	known := map[Stage]bool{}
+	for _, st := range pipelineStages {
+		known[st] = true
+	}
+	set := map[Stage]bool{}
+	for _, name := range strings.Split(list, ",") {
+		st := Stage(strings.TrimSpace(name))
+		if st == "" {
+			continue
+		}
+		if !known[st] {
+			return nil, fmt.Errorf("unknown stage %q", st)
+		}
+		set[st] = true
+	}
+	return set, nil
+}
+
+func joinStages(stages []Stage) string {
+	names := make([]string, len(stages))
+	for i, st := range stages {
+		names[i] = string(st)
+	}
+	return strings.Join(names, ", ")
+}
+
+// pipeline is the full stage order the options ask for, before --select
+// or --check-only narrow it down.
+func pipeline(cfg Config) []Stage {
 	order := []Stage{
 		StageDNSCheck,
 		StageRepoNet,
-		StageDetectEnv,
-		StageClearCache,
+	}
+	if cfg.CatalogSize {
+		order = append(order, StageCatalogSize)
+	}
+	order = append(order, StageDetectEnv, StagePkgLock, StageVerifyPkgSelf, StageKeysPerms, StageABIMatch)
+	if cfg.Facts {
+		order = append(order, StageSystemFacts)
+	}
+	order = append(order, StageStatsBefore, StageClearCache)
+	if cfg.Clean {
+		order = append(order, StagePkgClean)
+	}
+	order = append(order,
 		StagePkgUpdate,
 		StagePkgCheckDA,
 		StagePkgRecompute,
-		StagePkgCheckDA,
+		StagePkgRecheckDA,
 		StageMoveLocalDB,
+		StageStatsAfter,
+	)
+	if cfg.Upgrade {
+		order = append(order, StagePkgUpgrade)
+	}
+	if cfg.Audit {
+		order = append(order, StagePkgAudit)
+	}
+	if cfg.SmokePkg != "" {
+		order = append(order, StageSmokeTest)
+	}
+	if cfg.VerifyCmd != "" {
+		order = append(order, StageVerifyCmd)
+	}
+	if cfg.PreHook != "" {
+		order = append([]Stage{StagePreHook}, order...)
+	}
+	if cfg.PostHook != "" {
+		order = append(order, StagePostHook)
+	}
+	return order
+}
+
+func initialModel(cfg Config) model {
+	sp := spinner.New()
+	sp.Spinner = spinner.Dot
+	sp.Style = lipgloss.NewStyle().Foreground(lipgloss.Color("#003366"))
+	order := pipeline(cfg)
+	if cfg.Stages != nil {
+		var picked []Stage
+		for _, st := range order {
+			if cfg.Stages[st] {
+				picked = append(picked, st)
+			}
+		}
+		order = picked
+	}
+	var deferred []Stage
+	if cfg.CheckOnly {
+		var diag []Stage
+		for _, st := range order {
+			// The recount only means something after the repairs.
+			if isMutatingStage(st) || st == StageStatsAfter {
+				deferred = append(deferred, st)
+			} else {
+				diag = append(diag, st)
+			}
+		}
+		order = diag
+	}
+	if cfg.Restore {
+		order, deferred = []Stage{StageRestore}, nil
+	}
+	if cfg.SetBranch != "" {
+		order, deferred = []Stage{StageSetBranch}, nil
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	if cfg.Timeout > 0 {
+		ctx, cancel = context.WithTimeout(context.Background(), cfg.Timeout)
 	}
 	return model{
-		cfg:     cfg,
-		spin:    sp,
-		style:   newStyles(),
-		stOrder: order,
-		stMap:   map[Stage]Event{},
+		ctx:      ctx,
+		cancel:   cancel,
+		deferred: deferred,
+		cfg:      cfg,
+		spin:     sp,
+		style:    newStyles(plainStyles(cfg)),
+		stOrder:  order,
+		stMap:    map[Stage]Event{},
+		sinks:    newSinks(cfg),
+		started:  time.Now(),
+		stage:    &stageCtl{},
+	}
+}
+
+// stageCtl is the cancel func of the stage in flight, whether one is in
+// flight at all, and the stage whose result is to be dropped because the
+// user skipped it.
+type stageCtl struct {
+	cancel   context.CancelFunc
+	inFlight bool
+	skipped  Stage
+}
+
+// stageCtx derives the context of the stage about to be dispatched and
+// marks it in flight until its result arrives.
+func (m model) stageCtx() context.Context {
+	ctx, cancel := context.WithCancel(m.ctx)
+	m.stage.cancel = cancel
+	m.stage.inFlight = true
+	return ctx
+}
+
+// skip cancels the stage in flight and records it as skipped by the user;
+// its result, which arrives once the cancellation lands, is dropped.
+func (m model) skip() (model, tea.Cmd) {
+	st := m.stOrder[m.idx]
+	m.stage.cancel()
+	m.stage.inFlight = false
+	m.stage.skipped = st
+	ev := Event{
+		Time:       time.Now().UTC().Format(time.RFC3339),
+		Stage:      st,
+		Status:     StatusSkip,
+		SkipReason: SkipUserExcluded,
+		Message:    "skipped by user",
+	}
+	ev = m.settle(ev)
+	m.stMap[st] = ev
+	m.syncViewport()
+	return m, func() tea.Msg { return nextStageMsg{} }
+}
+
+// record appends ev to the run and hands it to every sink. Events built
+// outside runStage (skips, declines, the run's end) count one attempt.
+func (m *model) record(ev Event) {
+	if ev.Attempts == 0 {
+		ev.Attempts = 1
 	}
+	m.events = append(m.events, ev)
+	for _, s := range m.sinks {
+		s.Emit(ev)
+	}
+}
+
+// settle records a stage's result: appended normally, or replacing the
+// earlier result when the stage was re-run with r.
+func (m *model) settle(ev Event) Event {
+	if ev.Attempts == 0 {
+		ev.Attempts = 1
+	}
+	if !m.retrying {
+		m.record(ev)
+		return ev
+	}
+	m.retrying = false
+	return m.replace(ev)
+}
+
+// replace swaps ev in for the latest event of the same stage, counting
+// the re-run as another attempt. Streaming sinks get it as a new event;
+// the JSON report is built from the final events, so it has only this one.
+func (m *model) replace(ev Event) Event {
+	for i := len(m.events) - 1; i >= 0; i-- {
+		if m.events[i].Stage == ev.Stage {
+			ev.Attempts += m.events[i].Attempts
+			m.events[i] = ev
+			for _, s := range m.sinks {
+				s.Emit(ev)
+			}
+			return ev
+		}
+	}
+	m.record(ev)
+	return ev
+}
+
+// closeSinks flushes every sink with the final run summary, returning the
+// first error.
+func (m model) closeSinks() error {
+	sum := Summary{Status: worstStatus(m.events), Attempt: m.cfg.Attempt, Err: m.err, Events: m.events}
+	var first error
+	for _, s := range m.sinks {
+		if err := s.Close(sum); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
 }
 
+// Init dispatches the first stage through startStage, so it is confirmed
+// and prepared like any other even when --only or --select puts a
+// destructive stage first.
 func (m model) Init() tea.Cmd {
-	return tea.Batch(spinner.Tick, runStage(m.cfg, m.stOrder[0]))
+	if m.cfg.NoSpinner {
+		return tea.Batch(clockTick(), m.startStage())
+	}
+	return tea.Batch(spinner.Tick, m.startStage())
 }
 
 func (m model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
@@ -148,29 +613,389 @@ func (m model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 		var cmd tea.Cmd
 		m.spin, cmd = m.spin.Update(msg)
 		return m, cmd
+	case clockTickMsg:
+		if m.done {
+			return m, nil
+		}
+		return m, clockTick()
 	case eventMsg:
-		ev := Event(msg)
-		m.events = append(m.events, ev)
+		if m.aborted {
+			return m, nil
+		}
+		if msg.Stage == m.stage.skipped {
+			m.stage.skipped = ""
+			return m, nil
+		}
+		m.stage.inFlight = false
+		ev := m.settle(Event(msg))
 		m.stMap[ev.Stage] = ev
+		m.syncViewport()
+		if errors.Is(m.ctx.Err(), context.DeadlineExceeded) || blocksRun(ev) {
+			// Out of time, or pkg is busy: the remaining stages would
+			// only fail or race it.
+			return m.finish()
+		}
+		if f := editableConfig(m.cfg, ev); f != "" {
+			m.editPrompt = f
+			return m, nil
+		}
 		return m, func() tea.Msg { return nextStageMsg{} }
+	case tea.WindowSizeMsg:
+		m.vp.Width = msg.Width
+		m.vp.Height = max(msg.Height-strings.Count(m.header(), "\n")-1, 1)
+		m.ready = true
+		m.syncViewport()
+		return m, nil
+	case tea.KeyMsg:
+		if m.done && m.cfg.OnComplete == "wait" {
+			switch msg.String() {
+			case "up", "down", "pgup", "pgdown":
+				var cmd tea.Cmd
+				m.vp, cmd = m.vp.Update(msg)
+				return m, cmd
+			}
+		}
+		if m.done {
+			return m, tea.Quit
+		}
+		if k := msg.String(); k == "q" || k == "ctrl+c" {
+			return m.abort()
+		}
+		if m.awaitingConfirm {
+			switch msg.String() {
+			case "y", "Y":
+				m.awaitingConfirm = false
+				return m, runStage(m.stageCtx(), m.cfg, m.stOrder[m.idx])
+			case "n", "N", "enter", "esc":
+				m.awaitingConfirm = false
+				ev := Event{
+					Time:       time.Now().UTC().Format(time.RFC3339),
+					Stage:      m.stOrder[m.idx],
+					Status:     StatusSkip,
+					SkipReason: SkipUserExcluded,
+					Message:    declinedMessage(m.stOrder[m.idx]),
+				}
+				ev = m.settle(ev)
+				m.stMap[ev.Stage] = ev
+				return m, func() tea.Msg { return nextStageMsg{} }
+			}
+			return m, nil
+		}
+		if m.fixPrompt {
+			switch msg.String() {
+			case "y", "Y":
+				// Continue into the repair stages held back by --check-only.
+				m.fixPrompt = false
+				m.stOrder = append(m.stOrder, m.deferred...)
+				m.deferred = nil
+				return m, m.startStage()
+			case "n", "N", "enter", "esc":
+				m.fixPrompt = false
+				return m.finish()
+			}
+			return m, nil
+		}
+		if m.editPrompt != "" {
+			switch msg.String() {
+			case "y", "Y":
+				return m, editConfig(m.editPrompt)
+			case "n", "N", "enter", "esc":
+				m.editPrompt = ""
+				return m, func() tea.Msg { return nextStageMsg{} }
+			}
+			return m, nil
+		}
+		switch msg.String() {
+		case "p":
+			m.paused = !m.paused
+			if !m.paused && m.held {
+				m.held = false
+				return m, func() tea.Msg { return nextStageMsg{} }
+			}
+		case "s":
+			// Between a stage's result and the next dispatch there is
+			// nothing to skip, and skipping would advance twice.
+			if m.stage.inFlight {
+				return m.skip()
+			}
+		case "r":
+			// Only a held pipeline has a finished stage and nothing in
+			// flight; the re-run comes back here while still paused.
+			if m.held {
+				m.held = false
+				m.retrying = true
+				return m, m.startStage()
+			}
+		case "up", "down", "pgup", "pgdown":
+			var cmd tea.Cmd
+			m.vp, cmd = m.vp.Update(msg)
+			return m, cmd
+		}
+		return m, nil
+	case confirmMsg:
+		m.awaitingConfirm = true
+		m.syncViewport()
+		return m, nil
+	case editorDoneMsg:
+		if msg.err != nil {
+			m.record(Event{
+				Time:    time.Now().UTC().Format(time.RFC3339),
+				Stage:   m.stOrder[m.idx],
+				Status:  StatusWarn,
+				Message: "Could not edit " + m.editPrompt,
+				Detail:  msg.err.Error(),
+			})
+			m.editPrompt = ""
+			return m, func() tea.Msg { return nextStageMsg{} }
+		}
+		// Re-validate with the edited file before moving on.
+		m.editPrompt = ""
+		return m, runStage(m.stageCtx(), m.cfg, m.stOrder[m.idx])
 	case nextStageMsg:
+		if m.paused {
+			m.held = true
+			return m, nil
+		}
 		m.idx++
 		if m.idx >= len(m.stOrder) {
-			m.done = true
-			_ = writeJSONReport(m.cfg.JSONReport, m.events)
-			return m, tea.Quit
+			if len(m.deferred) > 0 && len(problems(m.events)) > 0 && isInteractive() {
+				m.fixPrompt = true
+				return m, nil
+			}
+			return m.finish()
 		}
-		return m, runStage(m.cfg, m.stOrder[m.idx])
+		return m, m.startStage()
 	case errMsg:
 		m.err = msg.err
 		m.done = true
-		_ = writeJSONReport(m.cfg.JSONReport, m.events)
-		return m, tea.Quit
+		m.ended = time.Now()
+		m = m.closeReport()
+		return m, m.quit()
 	}
 	return m, nil
 }
 
+// clockTick schedules the next clockTickMsg.
+func clockTick() tea.Cmd {
+	return tea.Tick(time.Second, func(time.Time) tea.Msg { return clockTickMsg{} })
+}
+
+// finish marks the run complete, writes the report and quits.
+func (m model) finish() (model, tea.Cmd) {
+	m.cancel()
+	m.done = true
+	m.ended = time.Now()
+	m.cleanupHook()
+	if m.cfg.RunRetries > 0 {
+		m.record(Event{
+			Time:    time.Now().UTC().Format(time.RFC3339),
+			Stage:   StageComplete,
+			Status:  worstStatus(m.events),
+			Message: fmt.Sprintf("Run finished after %d attempt(s)", m.cfg.Attempt),
+			Data:    map[string]any{"attempts": m.cfg.Attempt},
+		})
+	}
+	m = m.closeReport()
+	return m, m.quit()
+}
+
+// startStage runs the current stage, asking first when it is the
+// last-resort move of local.sqlite.
+func (m model) startStage() tea.Cmd {
+	st := m.stOrder[m.idx]
+	if allFailed, _ := m.stMap[StageDNSCheck].Data["all_failed"].(bool); st == StageRepoNet && allFailed {
+		// Probing mirrors that cannot be named would only repeat the DNS
+		// failure as a wall of unreachable repositories. This goes by the
+		// flag, not the status, which --dns-severity can change either way.
+		now := time.Now().UTC()
+		ev := Event{
+			Time:       now.Format(time.RFC3339),
+			Start:      now.Format(timestampMs),
+			End:        now.Format(timestampMs),
+			Attempts:   1,
+			Stage:      st,
+			Status:     StatusSkip,
+			SkipReason: SkipDependency,
+			Message:    "DNS resolution failed for every repository host",
+		}
+		return func() tea.Msg { return eventMsg(ev) }
+	}
+	if m.needsConfirm(st) {
+		return func() tea.Msg { return confirmMsg{stage: st} }
+	}
+	if st == StagePostHook {
+		cfg := m.cfg
+		cfg.RunStatus = worstStatus(m.events)
+		return runStage(m.stageCtx(), cfg, st)
+	}
+	if st == StageStatsAfter {
+		cfg := m.cfg
+		cfg.StatsBefore = -1
+		if n, ok := m.stMap[StageStatsBefore].Data["available"].(int); ok {
+			cfg.StatsBefore = n
+		}
+		return runStage(m.stageCtx(), cfg, st)
+	}
+	return runStage(m.stageCtx(), m.cfg, st)
+}
+
+// needsConfirm reports whether to prompt before moving local.sqlite or
+// upgrading packages. There is nothing to ask under --yes or --dry-run,
+// without a terminal, or when there is no database to move.
+func (m model) needsConfirm(st Stage) bool {
+	if m.cfg.Yes || m.cfg.DryRun || m.cfg.Plain || !isInteractive() {
+		return false
+	}
+	switch st {
+	case StageMoveLocalDB:
+		return fileExists(m.ctx, filepath.Join(pkgDBDir, "local.sqlite"))
+	case StagePkgUpgrade:
+		return true
+	}
+	return false
+}
+
+// confirmQuestion is the y/N prompt shown before st runs.
+func confirmQuestion(st Stage) string {
+	if st == StagePkgUpgrade {
+		return "Upgrade all installed packages now with pkg upgrade -y?"
+	}
+	return "Last resort: move " + filepath.Join(pkgDBDir, "local.sqlite") + " aside and rebuild it?"
+}
+
+// declinedMessage records the user answering no to confirmQuestion.
+func declinedMessage(st Stage) string {
+	if st == StagePkgUpgrade {
+		return "Declined; packages not upgraded"
+	}
+	return "Declined; local.sqlite left in place"
+}
+
+// abort cancels the stage in flight, records the partial run and quits.
+func (m model) abort() (model, tea.Cmd) {
+	m.cancel()
+	m.aborted = true
+	m.done = true
+	m.ended = time.Now()
+	m.cleanupHook()
+	m.record(Event{
+		Time:    time.Now().UTC().Format(time.RFC3339),
+		Stage:   StageComplete,
+		Status:  StatusWarn,
+		Message: "Aborted by user",
+	})
+	m = m.closeReport()
+	return m, tea.Quit
+}
+
+// cleanupHookTimeout bounds the post-hook run by cleanupHook, which holds
+// up the exit.
+const cleanupHookTimeout = time.Minute
+
+// cleanupHook runs the post-hook with PPR_STATUS=error when the run ends
+// (a held pkg lock, --timeout, q) before reaching it, so whatever the
+// pre-hook set up is still undone. It does nothing if the pre-hook never
+// ran or the post-hook already started. The run's context is cancelled by
+// now, so the hook gets its own.
+func (m *model) cleanupHook() {
+	if !slices.Contains(m.stOrder, StagePostHook) {
+		return
+	}
+	if _, ran := m.stMap[StagePreHook]; m.cfg.PreHook != "" && !ran {
+		return
+	}
+	if _, ran := m.stMap[StagePostHook]; ran || m.idx < len(m.stOrder) && m.stOrder[m.idx] == StagePostHook {
+		return
+	}
+	cfg := m.cfg
+	cfg.RunStatus = StatusError
+	ctx, cancel := context.WithTimeout(context.Background(), cleanupHookTimeout)
+	defer cancel()
+	msg, ok := runStage(ctx, cfg, StagePostHook)().(eventMsg)
+	if !ok {
+		return
+	}
+	ev := Event(msg)
+	ev.Message += " (run ended early)"
+	m.record(ev)
+	m.stMap[ev.Stage] = ev
+}
+
+// quit ends the program unless --on-complete=wait keeps the final screen
+// up until a key is pressed.
+func (m model) quit() tea.Cmd {
+	if m.cfg.OnComplete == "wait" {
+		return nil
+	}
+	return tea.Quit
+}
+
+// closeReport closes the sinks and, if the report could not be written,
+// records that as an error so it shows on screen and fails the run.
+func (m model) closeReport() model {
+	if err := m.closeSinks(); err != nil {
+		m.reportErr = err
+		m.events = append(m.events, reportFailure(err))
+	}
+	return m
+}
+
+// reportFailure is the event recorded when the report could not be
+// written. It can only be seen on screen and in the exit status.
+func reportFailure(err error) Event {
+	return Event{
+		Time:     time.Now().UTC().Format(time.RFC3339),
+		Stage:    StageComplete,
+		Status:   StatusError,
+		Attempts: 1,
+		Message:  "Report could not be written",
+		Detail:   err.Error(),
+	}
+}
+
+// problems lists the findings (warnings and errors) of a run.
+func problems(events []Event) []string {
+	var out []string
+	for _, ev := range events {
+		if ev.Status == StatusWarn || ev.Status == StatusError {
+			out = append(out, strings.ToLower(ev.Message))
+		}
+	}
+	return out
+}
+
 func (m model) View() string {
+	// Once the run has ended the whole body is printed so it stays in
+	// the terminal's scrollback.
+	if !m.ready || (m.done && m.cfg.OnComplete != "wait") {
+		return m.header() + m.body()
+	}
+	vp := m.vp
+	vp.SetContent(m.body())
+	if m.vp.AtBottom() {
+		vp.GotoBottom()
+	}
+	return m.header() + vp.View() + "\n"
+}
+
+// syncViewport refreshes the viewport's content, following new output
+// when it was already scrolled to the bottom.
+func (m *model) syncViewport() {
+	if !m.ready {
+		return
+	}
+	follow := m.vp.AtBottom()
+	m.vp.SetContent(m.body())
+	if follow {
+		m.vp.GotoBottom()
+	}
+}
+
+// header is the banner that stays fixed above the scrolling stage list.
+func (m model) header() string {
+	if m.cfg.Compact {
+		return ""
+	}
 	var b strings.Builder
 	b.WriteString(m.style.title.Render(appTitle))
 	b.WriteString("\n")
@@ -178,12 +1003,67 @@ func (m model) View() string {
 		b.WriteString(m.style.label.Render(l))
 		b.WriteString("\n")
 	}
-	b.WriteString("\n")
+	b.WriteString(m.style.label.Render(m.progress() + "   elapsed: " + clock(m.elapsed())))
+	b.WriteString("\n\n")
+	return b.String()
+}
 
-	for _, st := range m.stOrder {
+// progressWidth is the width of the header's progress bar.
+const progressWidth = 20
+
+// progress renders "Stage n/m" and a bar of the stages finished.
+func (m model) progress() string {
+	total := len(m.stOrder)
+	done := min(m.idx, total)
+	if m.done && !m.aborted {
+		done = total
+	}
+	filled := progressWidth * done / max(total, 1)
+	bar := strings.Repeat("#", filled) + strings.Repeat(".", progressWidth-filled)
+	return fmt.Sprintf("Stage %d/%d [%s]", min(done+1, total), total, bar)
+}
+
+// elapsed is how long the run has taken so far, or took once it ended.
+func (m model) elapsed() time.Duration {
+	if !m.ended.IsZero() {
+		return m.ended.Sub(m.started)
+	}
+	return time.Since(m.started)
+}
+
+// clock renders d as mm:ss, or h:mm:ss past an hour.
+func clock(d time.Duration) string {
+	s := int(d.Seconds())
+	if s >= 3600 {
+		return fmt.Sprintf("%d:%02d:%02d", s/3600, s/60%60, s%60)
+	}
+	return fmt.Sprintf("%02d:%02d", s/60, s%60)
+}
+
+// body renders the stage list, prompts and end-of-run summary.
+func (m model) body() string {
+	var b strings.Builder
+
+	if len(m.cfg.History) > 0 {
+		b.WriteString(m.style.section.Render("Previous runs"))
+		b.WriteString("\n")
+		for _, h := range m.cfg.History {
+			b.WriteString(m.style.detail.Render("  "+h) + "\n")
+		}
+		b.WriteString("\n")
+	}
+
+	for i, st := range m.stOrder {
 		ev, ok := m.stMap[st]
 		if !ok {
-			b.WriteString(m.spin.View() + " " + humanStage(st) + "\n")
+			switch {
+			case !m.cfg.NoSpinner:
+				b.WriteString(m.spin.View() + " " + humanStage(st) + "\n")
+			case i == m.idx && !m.done:
+				b.WriteString("  [ ] " + humanStage(st) + " — running…\n")
+			default:
+				b.WriteString("  [ ] " + humanStage(st) + "\n")
+			}
 			continue
 		}
 		icon := statusIcon(ev.Status)
@@ -193,7 +1073,7 @@ func (m model) View() string {
 			b.WriteString(m.style.ok.Render(line))
 		case StatusWarn:
 			b.WriteString(m.style.warn.Render(line))
-		case StatusSkip:
+		case StatusSkip, StatusInfo:
 			b.WriteString(m.style.skipped.Render(line))
 		case StatusError:
 			b.WriteString(m.style.error.Render(line))
@@ -202,38 +1082,542 @@ func (m model) View() string {
 			b.WriteString(": " + ev.Message)
 		}
 		b.WriteString("\n")
-		if ev.Detail != "" {
+		if ev.Detail != "" && !m.cfg.Compact {
 			b.WriteString(m.style.detail.Render(indent(ev.Detail)))
 			b.WriteString("\n")
 		}
 	}
 
+	switch {
+	case m.held:
+		b.WriteString(m.style.warn.Render("Paused — press p to resume, r to re-run " + humanStage(m.stOrder[m.idx])))
+		b.WriteString("\n")
+	case m.paused:
+		b.WriteString(m.style.warn.Render("Pausing after the current stage finishes… (p to cancel)"))
+		b.WriteString("\n")
+	}
+
+	if m.awaitingConfirm {
+		b.WriteString(m.style.warn.Render(confirmQuestion(m.stOrder[m.idx])))
+		b.WriteString("\n")
+		b.WriteString("Proceed? (y/N) ")
+		b.WriteString("\n")
+	}
+
+	if m.fixPrompt {
+		b.WriteString(m.style.warn.Render("Problems found: " + strings.Join(problems(m.events), ", ")))
+		b.WriteString("\n")
+		b.WriteString("Apply repairs now? (y/N) ")
+		b.WriteString("\n")
+	}
+
+	if m.editPrompt != "" {
+		b.WriteString(m.style.warn.Render("Repository config looks broken: " + m.editPrompt))
+		b.WriteString("\n")
+		b.WriteString("Back it up and open it in $EDITOR? (y/N) ")
+		b.WriteString("\n")
+	}
+
+	// --compact is one line per stage and nothing else.
+	if m.done && !m.cfg.Compact {
+		b.WriteString(m.style.section.Render("Summary"))
+		b.WriteString("\n")
+		b.WriteString(m.summaryTable())
+		if after := m.stMap[StageStatsAfter]; after.Data["before"] != nil {
+			b.WriteString(fmt.Sprintf("  Catalog: %v packages before, %v after\n", after.Data["before"], after.Data["available"]))
+		}
+		b.WriteString("\n")
+	}
+
+	if m.done && m.cfg.Timeline {
+		b.WriteString(m.style.section.Render("Timeline"))
+		b.WriteString("\n")
+		for _, l := range timelineChart(m.events, 40) {
+			b.WriteString(l + "\n")
+		}
+		b.WriteString("\n")
+	}
+
+	if m.done {
+		for _, ev := range m.events {
+			if ev.Attempts > 1 {
+				line := fmt.Sprintf("%s %s on attempt %d", humanStage(ev.Stage), outcome(ev.Status), ev.Attempts)
+				b.WriteString(m.style.warn.Render(line) + "\n")
+			}
+		}
+	}
+
+	if m.done && m.cfg.DryRun {
+		b.WriteString(m.style.section.Render("Dry-run plan (no changes were made)"))
+		b.WriteString("\n")
+		for _, l := range dryRunPlan(m.events) {
+			b.WriteString(l + "\n")
+		}
+		b.WriteString("\n")
+	}
+
+	if m.reportErr != nil {
+		b.WriteString(m.style.error.Render("Report could not be written: " + m.reportErr.Error()))
+		b.WriteString("\n")
+	}
+
 	if m.done {
-		if m.err != nil {
+		if m.aborted {
+			b.WriteString(m.style.warn.Render("Aborted by user"))
+		} else if m.err != nil {
 			b.WriteString(m.style.error.Render("Finished with errors."))
+		} else if m.cfg.Compact {
+			b.WriteString(m.style.ok.Render("Completed successfully."))
 		} else {
 			b.WriteString(m.style.ok.Render("Completed successfully. Run `pkg -vv` to confirm repos."))
 		}
+		if m.cfg.OnComplete == "wait" {
+			b.WriteString("\n" + m.style.detail.Render("Press any key to exit."))
+		}
 	}
 	b.WriteString("\n")
 	return b.String()
 }
 
-func statusIcon(s Status) string {
-	switch s {
-	case StatusOK:
-		return "[✓]"
-	case StatusWarn:
-		return "[!]"
-	case StatusSkip:
-		return "[...]"
-	case StatusError:
-		return "[x]"
-	default:
-		return "[ ]"
+// summaryTable lists every stage with its status and how long it took, in
+// aligned columns, as the at-a-glance picture of the run.
+func (m model) summaryTable() string {
+	nameW := 0
+	for _, st := range m.stOrder {
+		nameW = max(nameW, lipgloss.Width(humanStage(st)))
 	}
-}
-
+	name := lipgloss.NewStyle().Width(nameW + 4).PaddingLeft(2)
+	mark := lipgloss.NewStyle().Width(5)
+	dur := lipgloss.NewStyle().Width(10).Align(lipgloss.Right)
+	var rows []string
+	for _, st := range m.stOrder {
+		ev, ok := m.stMap[st]
+		if !ok {
+			rows = append(rows, lipgloss.JoinHorizontal(lipgloss.Top,
+				name.Render(humanStage(st)), mark.Render(m.style.skipped.Render("[ ]")), dur.Render("not run")))
+			continue
+		}
+		icon := m.style.ok
+		switch ev.Status {
+		case StatusWarn:
+			icon = m.style.warn
+		case StatusSkip, StatusInfo:
+			icon = m.style.skipped
+		case StatusError:
+			icon = m.style.error
+		}
+		rows = append(rows, lipgloss.JoinHorizontal(lipgloss.Top,
+			name.Render(humanStage(st)), mark.Render(icon.Render(statusIcon(ev.Status))),
+			dur.Render(eventDuration(ev).Truncate(time.Millisecond).String())))
+	}
+	return lipgloss.JoinVertical(lipgloss.Left, rows...) + "\n"
+}
+
+// timelineChart draws each stage as a horizontal bar positioned by its
+// start and end relative to the whole run.
+func timelineChart(events []Event, width int) []string {
+	type span struct {
+		name       string
+		start, end time.Time
+	}
+	var spans []span
+	var first, last time.Time
+	nameW := 0
+	for _, ev := range events {
+		start, err1 := time.Parse(timestampMs, ev.Start)
+		end, err2 := time.Parse(timestampMs, ev.End)
+		if err1 != nil || err2 != nil {
+			continue
+		}
+		if first.IsZero() || start.Before(first) {
+			first = start
+		}
+		if end.After(last) {
+			last = end
+		}
+		name := humanStage(ev.Stage)
+		nameW = max(nameW, len([]rune(name)))
+		spans = append(spans, span{name, start, end})
+	}
+	total := last.Sub(first)
+	if len(spans) == 0 || total <= 0 {
+		return nil
+	}
+	var lines []string
+	for _, sp := range spans {
+		from := int(int64(width) * int64(sp.start.Sub(first)) / int64(total))
+		to := int(int64(width) * int64(sp.end.Sub(first)) / int64(total))
+		to = min(max(to, from+1), width)
+		from = min(from, to-1)
+		bar := strings.Repeat(".", from) + strings.Repeat("#", to-from) + strings.Repeat(".", width-to)
+		pad := strings.Repeat(" ", nameW-len([]rune(sp.name)))
+		lines = append(lines, fmt.Sprintf("  %s%s |%s| %s", sp.name, pad, bar, sp.end.Sub(sp.start).Truncate(time.Millisecond)))
+	}
+	return lines
+}
+
+func outcome(s Status) string {
+	switch s {
+	case StatusOK, StatusInfo:
+		return "succeeded"
+	case StatusSkip:
+		return "was skipped"
+	}
+	return "finished with " + string(s)
+}
+
+func statusIcon(s Status) string {
+	switch s {
+	case StatusOK:
+		return "[✓]"
+	case StatusWarn:
+		return "[!]"
+	case StatusSkip:
+		return "[...]"
+	case StatusInfo:
+		return "[i]"
+	case StatusError:
+		return "[x]"
+	default:
+		return "[ ]"
+	}
+}
+
+// editableConfig returns the repo config file to offer for editing after
+// ev, or "" when no prompt should be shown.
+func editableConfig(cfg Config, ev Event) string {
+	// Editing rewrites the config (and a backup), so --dry-run never offers it.
+	if !cfg.EditConfig || cfg.DryRun || !isInteractive() || ev.Stage != StageRepoNet || ev.Status == StatusOK {
+		return ""
+	}
+	f, _ := ev.Data["config_file"].(string)
+	return f
+}
+
+func isInteractive() bool {
+	for _, f := range []*os.File{os.Stdin, os.Stdout} {
+		fi, err := f.Stat()
+		if err != nil || fi.Mode()&os.ModeCharDevice == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// editConfig backs up path and hands the terminal to $EDITOR.
+func editConfig(path string) tea.Cmd {
+	if _, err := backupFile(path); err != nil {
+		return func() tea.Msg { return editorDoneMsg{err: err} }
+	}
+	editor := os.Getenv("EDITOR")
+	if editor == "" {
+		editor = "vi"
+	}
+	return tea.ExecProcess(exec.Command(editor, path), func(err error) tea.Msg {
+		return editorDoneMsg{err: err}
+	})
+}
+
+// backupFile copies path to path.<timestamp>.bak and returns the copy's name.
+func backupFile(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+	backup := backupName(path, time.Now(), func(p string) bool {
+		_, err := os.Stat(p)
+		return err == nil
+	})
+	return backup, os.WriteFile(backup, data, fi.Mode().Perm())
+}
+
+// replaceFile atomically replaces path with data, keeping its permissions:
+// the data is written to a temporary file beside it and renamed over it.
+func replaceFile(path string, data []byte) error {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(fi.Mode().Perm()); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// backupName returns path.<timestamp>.bak, adding a counter
+// (path.<timestamp>.1.bak, ...) if that name is already taken, so an
+// earlier backup is never overwritten.
+func backupName(path string, t time.Time, exists func(string) bool) string {
+	base := path + "." + t.Format("2006-01-02T15-04-05")
+	name := base + ".bak"
+	for i := 1; exists(name); i++ {
+		name = fmt.Sprintf("%s.%d.bak", base, i)
+	}
+	return name
+}
+
+func statusRank(s Status) int {
+	switch s {
+	case StatusSkip:
+		return 1
+	case StatusWarn:
+		return 2
+	case StatusError:
+		return 3
+	default:
+		return 0
+	}
+}
+
+func worstStatus(events []Event) Status {
+	worst := StatusOK
+	for _, ev := range events {
+		if statusRank(ev.Status) > statusRank(worst) {
+			worst = ev.Status
+		}
+	}
+	return worst
+}
+
+// isTransientFailure reports whether a run failed only in network-bound
+// stages, which is worth retrying. Local problems such as not running as
+// root or a full disk will not fix themselves.
+func isTransientFailure(events []Event) bool {
+	failed := false
+	for _, ev := range events {
+		if ev.Status != StatusWarn && ev.Status != StatusError {
+			continue
+		}
+		if !isNetworkStage(ev.Stage) {
+			return false
+		}
+		failed = true
+	}
+	return failed
+}
+
+// exitCode maps the final model to the exit codes documented in README.
+func exitCode(m model) int {
+	if m.aborted {
+		return 130
+	}
+	if ev, ok := m.stMap[StageDetectEnv]; ok && ev.Status == StatusError {
+		return 126
+	}
+	if n, _ := m.stMap[StagePkgAudit].Data["vulnerable"].(int); m.cfg.AuditFail && n > 0 {
+		return 1
+	}
+	worst := worstStatus(m.events)
+	if m.err != nil || worst == StatusError || (m.cfg.Strict && worst == StatusWarn) {
+		return 1
+	}
+	return 0
+}
+
+// exitExplanation names the stages responsible for a non-zero exit, e.g.
+// `ppr exiting 1: error in "Verify package DB"`.
+func exitExplanation(code int, m model) string {
+	worst := worstStatus(m.events)
+	var culprits []string
+	for _, ev := range m.events {
+		if ev.Status == worst && ev.Stage != StageComplete {
+			culprits = append(culprits, fmt.Sprintf("%q", humanStage(ev.Stage)))
+		}
+	}
+	msg := fmt.Sprintf("ppr exiting %d: %s", code, worst)
+	if len(culprits) > 0 {
+		msg += " in " + strings.Join(culprits, ", ")
+	}
+	if m.err != nil {
+		msg += fmt.Sprintf(" (%v)", m.err)
+	}
+	if m.reportErr != nil {
+		msg += " (report not written)"
+	}
+	return msg
+}
+
+// runHook runs a --pre-hook or --post-hook command on the target with env
+// added to its environment. A failing hook is a warning: it is the site's
+// own step, not part of the repair.
+func runHook(ctx context.Context, ev Event, command string, env []string) tea.Msg {
+	args := append(append([]string{}, env...), "/bin/sh", "-c", command)
+	out, err := runCmdCapture(ctx, "env", args)
+	code := exitStatus(err)
+	ev.ExitCode = &code
+	ev.Data = map[string]any{"command": command, "exit_code": code}
+	if err != nil {
+		ev.Status = StatusWarn
+		ev.Message = fmt.Sprintf("Hook failed (exit=%d)", code)
+		ev.Detail = tail(out+"\n"+err.Error(), 300)
+		return eventMsg(ev)
+	}
+	ev.Status = StatusOK
+	ev.Message = "Hook succeeded (exit=0)"
+	ev.Detail = tail(out, 200)
+	return eventMsg(ev)
+}
+
+// isMutatingStage reports whether a stage changes the system. Under
+// --dry-run these are previewed while read-only stages still run for real.
+func isMutatingStage(s Stage) bool {
+	switch s {
+	case StageClearCache, StagePkgUpdate, StagePkgRecompute, StageMoveLocalDB, StageVerifyCmd, StageRestore,
+		StagePreHook, StagePostHook, StagePkgUpgrade, StagePkgClean, StageSetBranch:
+		return true
+	}
+	return false
+}
+
+// previewStage describes what a mutating stage would do without doing it.
+func previewStage(ctx context.Context, cfg Config, ev Event) Event {
+	ev.Status = StatusSkip
+	ev.SkipReason = SkipDryRun
+	var would []string
+	switch ev.Stage {
+	case StageClearCache:
+		paths, err := globRepoSqlite(ctx, cfg.CacheGlobs)
+		if err != nil {
+			ev.Message = "dry-run: could not scan " + pkgDBDir
+			ev.Detail = err.Error()
+			return ev
+		}
+		if len(paths) == 0 {
+			ev.Message = "dry-run: repo cache already clean"
+			return ev
+		}
+		for _, p := range paths {
+			would = append(would, "rm -f "+p)
+		}
+		ev.Message = fmt.Sprintf("dry-run: would remove %d cached catalog file(s)", len(paths))
+	case StagePkgUpdate:
+		would = []string{"pkg update -f"}
+		ev.Message = "dry-run: would force a catalog update"
+	case StagePkgRecompute:
+		would = []string{"pkg check -r -a"}
+		ev.Message = "dry-run: would recompute package metadata"
+	case StageMoveLocalDB:
+		localDB := filepath.Join(pkgDBDir, "local.sqlite")
+		if !fileExists(ctx, localDB) {
+			ev.Message = "dry-run: no local.sqlite found, nothing to move"
+			return ev
+		}
+		would = []string{"mv " + localDB + " " + localDB + ".$(date +%Y-%m-%dT%H-%M-%S).bak", "pkg update -f", "pkg check -da"}
+		ev.Message = "dry-run: would move local.sqlite aside and rebuild"
+	case StageVerifyCmd:
+		would = []string{cfg.VerifyCmd}
+		ev.Message = "dry-run: would run the verification command"
+	case StageSetBranch:
+		ev.Status, ev.Message, ev.Detail, ev.Data = setBranch(ctx, cfg, true)
+		if ev.Status == StatusOK {
+			ev.Status, ev.SkipReason = StatusSkip, SkipDryRun
+			ev.Message = "dry-run: " + ev.Message
+		}
+		return ev
+	case StagePkgClean:
+		would = []string{"pkg clean -a -y"}
+		ev.Message = "dry-run: would delete all cached package archives"
+	case StagePkgUpgrade:
+		out, err := runCmdCapture(ctx, "pkg", []string{"upgrade", "-n"})
+		would = []string{"pkg upgrade -y"}
+		ev.Message = "dry-run: would upgrade packages"
+		// pkg upgrade -n exits 1 when there is something to upgrade.
+		if err != nil && exitStatus(err) != 1 {
+			ev.Message = "dry-run: could not list upgrades"
+		}
+		ev.Detail = "would run: pkg upgrade -y\n" + tail(out, 600)
+		ev.Data = map[string]any{"dry_run": true, "would_run": would}
+		return ev
+	case StagePreHook:
+		would = []string{cfg.PreHook}
+		ev.Message = "dry-run: would run the pre-repair hook"
+	case StagePostHook:
+		would = []string{cfg.PostHook}
+		ev.Message = "dry-run: would run the post-repair hook"
+	case StageRestore:
+		backup, err := latestBackup(ctx)
+		if err != nil {
+			ev.Message = "dry-run: " + err.Error()
+			return ev
+		}
+		would = []string{"mv " + backup + " " + filepath.Join(pkgDBDir, "local.sqlite")}
+		ev.Message = "dry-run: would restore " + filepath.Base(backup)
+	}
+	ev.Detail = "would run: " + strings.Join(would, "\nwould run: ")
+	ev.Data = map[string]any{"dry_run": true, "would_run": would}
+	return ev
+}
+
+// dryRunPlan summarises a --dry-run: each previewed action together with
+// the live findings from the read-only stages that motivate or block it.
+func dryRunPlan(events []Event) []string {
+	var netProblem, dnsProblem string
+	for _, ev := range events {
+		switch {
+		case ev.Stage == StageRepoNet && ev.Status != StatusOK && ev.Status != StatusSkip:
+			netProblem = strings.ToLower(ev.Message)
+		case ev.Stage == StageDNSCheck && ev.Status != StatusOK && ev.Status != StatusSkip:
+			dnsProblem = strings.ToLower(ev.Message)
+		}
+	}
+	var lines []string
+	for _, ev := range events {
+		would, _ := ev.Data["would_run"].([]string)
+		if len(would) == 0 {
+			continue
+		}
+		line := strings.TrimPrefix(ev.Message, "dry-run: ")
+		switch ev.Stage {
+		case StageClearCache:
+			if netProblem != "" {
+				line += " (note: " + netProblem + "; the refetch may fail)"
+			} else {
+				line += " so fresh catalogs are fetched from reachable repositories"
+			}
+		case StagePkgUpdate:
+			switch {
+			case dnsProblem != "":
+				line += " (blocked: " + dnsProblem + ")"
+			case netProblem != "":
+				line += " (likely to fail: " + netProblem + ")"
+			default:
+				line += " (repositories reachable)"
+			}
+		}
+		lines = append(lines, "- "+line)
+	}
+	if len(lines) == 0 {
+		lines = append(lines, "- nothing to change")
+	}
+	return lines
+}
+
+// isNetworkStage reports whether a stage needs to reach the repositories.
+func isNetworkStage(s Stage) bool {
+	switch s {
+	case StageDNSCheck, StageRepoNet, StageCatalogSize, StagePkgUpdate, StageSmokeTest, StagePkgUpgrade, StagePkgAudit:
+		return true
+	}
+	return false
+}
+
 func humanStage(s Stage) string {
 	switch s {
 	case StageDNSCheck:
@@ -242,196 +1626,763 @@ func humanStage(s Stage) string {
 		return "Check repository network"
 	case StageDetectEnv:
 		return "Detect environment"
+	case StagePkgLock:
+		return "Check for a running pkg"
+	case StageVerifyPkgSelf:
+		return "Verify pkg itself"
+	case StageKeysPerms:
+		return "Check pkg key permissions"
+	case StageABIMatch:
+		return "Check installed package ABI"
+	case StageSystemFacts:
+		return "Collect system facts"
+	case StageCatalogSize:
+		return "Estimate catalog download size"
 	case StageClearCache:
 		return "Clear repo cache"
+	case StagePkgClean:
+		return "Clean package cache"
 	case StagePkgUpdate:
 		return "Force pkg update"
 	case StagePkgCheckDA:
 		return "Verify package DB"
+	case StagePkgRecheckDA:
+		return "Re-verify package DB"
 	case StagePkgRecompute:
 		return "Recompute package metadata"
 	case StageMoveLocalDB:
 		return "Last resort: move local.sqlite"
+	case StagePkgUpgrade:
+		return "Upgrade packages"
+	case StagePkgAudit:
+		return "Audit installed packages"
+	case StageStatsBefore:
+		return "Count catalog packages"
+	case StageStatsAfter:
+		return "Recount catalog packages"
+	case StageSmokeTest:
+		return "Smoke-test the repaired catalog"
+	case StageVerifyCmd:
+		return "Run site verification command"
+	case StagePreHook:
+		return "Run pre-repair hook"
+	case StagePostHook:
+		return "Run post-repair hook"
+	case StageRestore:
+		return "Restore local.sqlite from backup"
+	case StageSetBranch:
+		return "Switch repository branch"
 	default:
 		return string(s)
 	}
 }
 
-func runStage(cfg Config, st Stage) tea.Cmd {
+// runStage runs st under parent, so cancelling the run's context or
+// reaching its deadline stops the stage's commands. --stage-timeout
+// further limits the stage on its own.
+func runStage(parent context.Context, cfg Config, st Stage) tea.Cmd {
 	return func() tea.Msg {
-		ctx, cancel := context.WithTimeout(context.Background(), cfg.Timeout)
+		ctx, cancel := parent, context.CancelFunc(func() {})
+		if cfg.StageTimeout > 0 {
+			ctx, cancel = context.WithTimeout(parent, cfg.StageTimeout)
+		}
 		defer cancel()
-		ev := Event{Time: time.Now().UTC().Format(time.RFC3339), Stage: st}
-
-		switch st {
-		case StageDNSCheck:
-			msg, detail, ok := checkDNS(ctx)
-			if ok {
-				ev.Status = StatusOK
-			} else {
-				ev.Status = StatusWarn
-			}
-			ev.Message = msg
-			ev.Detail = detail
-			return eventMsg(ev)
-
-		case StageRepoNet:
-			msg, detail, ok := checkRepoNetwork(ctx)
-			if ok {
-				ev.Status = StatusOK
-			} else {
-				ev.Status = StatusWarn
+		start := time.Now()
+		msg := execStage(ctx, cfg, st)
+		if ev, ok := msg.(eventMsg); ok {
+			if ev.Attempts == 0 {
+				ev.Attempts = 1
 			}
-			ev.Message = msg
-			ev.Detail = detail
-			return eventMsg(ev)
-
-		case StageDetectEnv:
-			if os.Geteuid() != 0 {
+			if errors.Is(ctx.Err(), context.DeadlineExceeded) {
 				ev.Status = StatusError
-				ev.Message = "Must run as root"
-				return eventMsg(ev)
-			}
-			ev.Status = StatusOK
-			ev.Message = "Running as root"
-			return eventMsg(ev)
-
-		case StageClearCache:
-			paths, err := globRepoSqlite()
-			if err != nil {
-				ev.Status = StatusWarn
-				ev.Message = "Could not scan /var/db/pkg"
-				ev.Detail = err.Error()
-				return eventMsg(ev)
-			}
-			if len(paths) == 0 {
-				ev.Status = StatusOK
-				ev.Message = "Repo cache already clean"
-				ev.Detail = "Checked /var/db/pkg for repo-*.sqlite*"
-				return eventMsg(ev)
-			}
-			for _, p := range paths {
-				_ = os.Remove(p)
-			}
-			ev.Status = StatusOK
-			ev.Message = "Removed cached repo catalogs"
-			ev.Detail = strings.Join(paths, "\n")
-			return eventMsg(ev)
-
-		case StagePkgUpdate:
-			return runAndReport(ctx, ev, "pkg", []string{"update", "-f"},
-				"pkg update completed", "pkg update had problems. Tried bootstrap and retry", true)
-
-		case StagePkgCheckDA:
-			return runAndReport(ctx, ev, "pkg", []string{"check", "-da"},
-				"Local package database looks consistent", "Integrity issues detected", false)
-
-		case StagePkgRecompute:
-			return runAndReport(ctx, ev, "pkg", []string{"check", "-r", "-a"},
-				"Recomputed package metadata", "Recompute reported problems", false)
-
-		case StageMoveLocalDB:
-			localDB := "/var/db/pkg/local.sqlite"
-			if _, err := os.Stat(localDB); err == nil {
-				backup := localDB + ".bak"
-				if err := os.Rename(localDB, backup); err != nil {
-					ev.Status = StatusWarn
-					ev.Message = "Could not move local.sqlite"
-					ev.Detail = err.Error()
-					return eventMsg(ev)
+				ev.SkipReason = ""
+				if errors.Is(parent.Err(), context.DeadlineExceeded) {
+					ev.Message = fmt.Sprintf("run timed out (--timeout %s)", cfg.Timeout)
+				} else {
+					ev.Message = fmt.Sprintf("stage timed out (--stage-timeout %s)", cfg.StageTimeout)
 				}
-				ev.Status = StatusOK
-				ev.Message = "Moved local.sqlite aside"
-				ev.Detail = localDB + " -> " + backup
-				_, _ = runCmdCapture(ctx, "pkg", []string{"update", "-f"})
-				_, _ = runCmdCapture(ctx, "pkg", []string{"check", "-da"})
-				return eventMsg(ev)
 			}
-			// softened tone here
-			ev.Status = StatusOK
-			ev.Message = "No local.sqlite found"
-			ev.Detail = "Package database is already in a clean state"
-			return eventMsg(ev)
+			end := time.Now()
+			ev.Start = start.UTC().Format(timestampMs)
+			ev.End = end.UTC().Format(timestampMs)
+			ev.DurationMs = end.Sub(start).Milliseconds()
+			return ev
 		}
-		ev.Status = StatusSkip
-		ev.Message = "No-op"
-		return eventMsg(ev)
+		return msg
 	}
 }
 
-// Run a command and map output to event
-func runAndReport(ctx context.Context, ev Event, name string, args []string, okMsg, warnMsg string, tryBootstrap bool) tea.Msg {
-	out, err := runCmdCapture(ctx, name, args)
-	if err != nil && tryBootstrap {
-		_, _ = runCmdCapture(ctx, "pkg", []string{"bootstrap", "-f"})
-		out2, _ := runCmdCapture(ctx, name, args)
-		ev.Status = StatusWarn
-		ev.Message = warnMsg
-		ev.Detail = tail(out+"\n"+out2, 300)
+// execStage performs a single stage and reports its outcome.
+func execStage(ctx context.Context, cfg Config, st Stage) tea.Msg {
+	ev := Event{Time: time.Now().UTC().Format(time.RFC3339), Stage: st}
+
+	if cfg.Offline && isNetworkStage(st) {
+		ev.Status = StatusSkip
+		ev.SkipReason = SkipOffline
+		ev.Message = "offline mode"
 		return eventMsg(ev)
 	}
-	if err != nil {
-		ev.Status = StatusWarn
-		ev.Message = warnMsg
-		ev.Detail = tail(out+"\n"+err.Error(), 300)
+	if cfg.DryRun && isMutatingStage(st) {
+		return eventMsg(previewStage(ctx, cfg, ev))
+	}
+	if !hostLocal() && !remoteCapable(st) {
+		ev.Status = StatusSkip
+		ev.SkipReason = SkipNotApplicable
+		ev.Message = "Not supported with --remote or --jail"
 		return eventMsg(ev)
 	}
-	ev.Status = StatusOK
-	ev.Message = okMsg
-	ev.Detail = tail(out, 200)
-	return eventMsg(ev)
-}
 
-// --- DNS check ---
+	switch st {
+	case StageDNSCheck:
+		r := checkDNS(ctx, cfg)
+		ev.Status = r.status(cfg.DNSSeverity)
+		ev.Message = r.Message
+		ev.Detail = r.Detail
+		ev.Data = map[string]any{"hosts": r.Hosts, "addresses": r.Addrs, "latency_ms": r.Latency, "all_failed": r.AllFailed}
+		return eventMsg(ev)
 
-func checkDNS(ctx context.Context) (string, string, bool) {
-	// Read resolv.conf
-	resolvPath := "/etc/resolv.conf"
-	data, err := os.ReadFile(resolvPath)
-	var nameservers []string
-	if err == nil {
-		sc := bufio.NewScanner(strings.NewReader(string(data)))
-		for sc.Scan() {
-			line := strings.TrimSpace(sc.Text())
-			if strings.HasPrefix(line, "nameserver") {
-				fields := strings.Fields(line)
-				if len(fields) >= 2 {
-					nameservers = append(nameservers, fields[1])
+	case StageRepoNet:
+		r := checkRepoNetwork(ctx, cfg)
+		ev.Data = r.data()
+		if r.OK {
+			ev.Status = StatusOK
+		} else {
+			ev.Status = StatusWarn
+			// Config files are only known for this machine, not a --remote
+			// host or --jail, and a slow or degraded mirror is no reason
+			// to edit one.
+			if len(r.Broken) > 0 && hostLocal() {
+				if f := repoConfFile(cfg, r.Broken); f != "" {
+					if ev.Data == nil {
+						ev.Data = map[string]any{}
+					}
+					ev.Data["config_file"] = f
 				}
 			}
 		}
-	}
+		ev.Message = r.Message
+		ev.Detail = r.detail()
+		return eventMsg(ev)
 
-	// Derive targets from pkg -vv (repo URLs → hosts)
-	abi, _ := runCmdCapture(ctx, "pkg", []string{"config", "ABI"})
-	vv, errVV := runCmdCapture(ctx, "pkg", []string{"-vv"})
-	var hosts []string
-	seen := map[string]bool{}
-	if errVV == nil {
-		for _, u := range parseRepoURLs(vv, strings.TrimSpace(abi)) {
-			if pu, err := url.Parse(u); err == nil && pu.Host != "" {
-				h := pu.Host
-				// strip port if present
-				if i := strings.Index(h, ":"); i >= 0 {
-					h = h[:i]
-				}
-				if !seen[h] {
-					seen[h] = true
-					hosts = append(hosts, h)
-				}
-			}
+	case StageDetectEnv:
+		if effectiveUID(ctx) != 0 {
+			ev.Status = StatusError
+			ev.Message = "Must run as root"
+			return eventMsg(ev)
 		}
-	}
-	// Add common defaults if none parsed
-	if len(hosts) == 0 {
-		for _, h := range []string{"pkg.freebsd.org", "pkg.ghostbsd.org"} {
-			if !seen[h] {
-				seen[h] = true
-				hosts = append(hosts, h)
+		osInfo := detectOS(ctx)
+		ev.Data = osInfo.data()
+		ev.Detail = osInfo.detail()
+		if t := targetDescription(cfg); t != "" {
+			ev.Data["target"] = t
+			ev.Detail = "Target: " + t + "\n" + ev.Detail
+		}
+		if free, db, err := dbSpace(ctx); err == nil {
+			want := max(2*db, minFreeBytes)
+			ev.Data["free_bytes"] = free
+			ev.Data["db_bytes"] = db
+			ev.Detail += fmt.Sprintf("\nFree in %s: %s (database %s, want at least %s)",
+				pkgDBDir, humanBytes(free), humanBytes(db), humanBytes(want))
+			if free < want {
+				ev.Status = StatusWarn
+				ev.Message = "Only " + humanBytes(free) + " free for the package database; the rebuild may fail with a full disk"
+				return eventMsg(ev)
 			}
 		}
-	}
-
+		if osInfo.Name == "" {
+			ev.Status = StatusWarn
+			ev.Message = "Running as root, but could not determine the OS"
+			return eventMsg(ev)
+		}
+		ev.Status = StatusOK
+		ev.Message = "Running as root on " + osInfo.Name + " " + osInfo.Version
+		return eventMsg(ev)
+
+	case StagePkgLock:
+		procs := runningPkg(ctx)
+		if len(procs) > 0 {
+			ev.Status = StatusError
+			ev.Message = "Another pkg process is running; wait for it to finish, then rerun ppr"
+			ev.Detail = strings.Join(procs, "\n")
+			return eventMsg(ev)
+		}
+		ev.Status = StatusOK
+		ev.Message = "No other pkg process is running"
+		return eventMsg(ev)
+
+	case StageCatalogSize:
+		msg, detail, data := estimateCatalogSize(ctx, cfg)
+		ev.Status = StatusInfo
+		ev.Message = msg
+		ev.Detail = detail
+		ev.Data = data
+		return eventMsg(ev)
+
+	case StageVerifyPkgSelf:
+		msg, detail, ok := verifyPkgSelf(ctx)
+		if ok {
+			ev.Status = StatusOK
+		} else {
+			ev.Status = StatusWarn
+		}
+		ev.Message = msg
+		ev.Detail = detail
+		return eventMsg(ev)
+
+	case StageKeysPerms:
+		msg, detail, ok := checkKeysPerms(pkgKeysDir)
+		if ok {
+			ev.Status = StatusOK
+		} else {
+			ev.Status = StatusWarn
+		}
+		ev.Message = msg
+		ev.Detail = detail
+		return eventMsg(ev)
+
+	case StageABIMatch:
+		msg, detail, ok := checkInstalledABI(ctx)
+		if ok {
+			ev.Status = StatusOK
+		} else {
+			ev.Status = StatusWarn
+		}
+		ev.Message = msg
+		ev.Detail = detail
+		return eventMsg(ev)
+
+	case StageSystemFacts:
+		facts, detail := collectSystemFacts(ctx, cfg)
+		ev.Status = StatusOK
+		ev.Message = "Collected system facts"
+		ev.Detail = detail
+		ev.Data = facts
+		return eventMsg(ev)
+
+	case StageClearCache:
+		paths, err := globRepoSqlite(ctx, cfg.CacheGlobs)
+		if err != nil {
+			ev.Status = StatusWarn
+			ev.Message = "Could not scan " + pkgDBDir
+			ev.Detail = err.Error()
+			return eventMsg(ev)
+		}
+		if len(paths) == 0 {
+			ev.Status = StatusOK
+			ev.Message = "Repo cache already clean"
+			ev.Detail = "Checked " + pkgDBDir + " for " + strings.Join(cacheGlobs(cfg), ", ")
+			return eventMsg(ev)
+		}
+		if refused := disallowedPaths(ctx, pkgDBDir, paths); len(refused) > 0 {
+			ev.Status = StatusError
+			ev.Message = "Refusing to remove files outside the catalog allowlist"
+			ev.Detail = strings.Join(refused, "\n")
+			return eventMsg(ev)
+		}
+		removeFiles(ctx, paths)
+		ev.Status = StatusOK
+		ev.Message = "Removed cached repo catalogs"
+		ev.Detail = strings.Join(paths, "\n")
+		return eventMsg(ev)
+
+	case StagePkgUpdate:
+		return runAndReportWith(ctx, ev, "pkg", []string{"update", "-f"},
+			"pkg update completed", "pkg update had problems. Tried bootstrap and retry", true, annotatePkgUpdate)
+
+	case StagePkgCheckDA, StagePkgRecheckDA:
+		return runAndReportWith(ctx, ev, "pkg", []string{"check", "-da"},
+			"Local package database looks consistent", "Integrity issues detected", false, annotatePkgCheck)
+
+	case StagePkgRecompute:
+		return runAndReport(ctx, ev, "pkg", []string{"check", "-r", "-a"},
+			"Recomputed package metadata", "Recompute reported problems", false)
+
+	case StageSmokeTest:
+		msg, detail, ok := smokeTest(ctx, cfg.SmokePkg)
+		if ok {
+			ev.Status = StatusOK
+		} else {
+			ev.Status = StatusError
+		}
+		ev.Message = msg
+		ev.Detail = detail
+		ev.Data = map[string]any{"package": cfg.SmokePkg}
+		return eventMsg(ev)
+
+	case StageVerifyCmd:
+		out, err := runCmdCapture(ctx, "/bin/sh", []string{"-c", cfg.VerifyCmd})
+		code := exitStatus(err)
+		ev.ExitCode = &code
+		ev.Data = map[string]any{"command": cfg.VerifyCmd, "exit_code": code}
+		if err != nil {
+			ev.Status = StatusError
+			ev.Message = fmt.Sprintf("Verification command failed (exit=%d)", code)
+			ev.Detail = tail(out+"\n"+err.Error(), 300)
+			return eventMsg(ev)
+		}
+		ev.Status = StatusOK
+		ev.Message = "Verification command succeeded (exit=0)"
+		ev.Detail = tail(out, 200)
+		return eventMsg(ev)
+
+	case StageStatsBefore, StageStatsAfter:
+		n, out, err := remotePackages(ctx)
+		if err != nil {
+			ev.Status = StatusInfo
+			ev.Message = "pkg stats could not read the catalog"
+			ev.Detail = tail(out+"\n"+err.Error(), 300)
+			ev.Data = map[string]any{"available": 0}
+			if st == StageStatsAfter {
+				ev.Status = StatusWarn
+			}
+			return eventMsg(ev)
+		}
+		ev.Status = StatusOK
+		ev.Message = fmt.Sprintf("%d packages available from the repositories", n)
+		ev.Data = map[string]any{"available": n}
+		if st == StageStatsAfter && cfg.StatsBefore >= 0 {
+			ev.Message = fmt.Sprintf("Packages available: %d before the repair, %d after (%+d)", cfg.StatsBefore, n, n-cfg.StatsBefore)
+			ev.Data["before"] = cfg.StatsBefore
+		}
+		if st == StageStatsAfter && n == 0 {
+			ev.Status = StatusWarn
+			ev.Message = "The catalog still lists no packages"
+		}
+		return eventMsg(ev)
+
+	case StageSetBranch:
+		ev.Status, ev.Message, ev.Detail, ev.Data = setBranch(ctx, cfg, false)
+		return eventMsg(ev)
+
+	case StagePkgAudit:
+		out, err := runCmdCapture(ctx, "pkg", []string{"audit", "-F"})
+		code := exitStatus(err)
+		ev.ExitCode = &code
+		vulns := reVulnerable.FindAllStringSubmatch(out, -1)
+		switch {
+		case len(vulns) > 0:
+			var names, lines []string
+			for _, v := range vulns {
+				names = append(names, v[1])
+				lines = append(lines, v[1]+": "+strings.TrimSpace(v[2]))
+			}
+			ev.Status = StatusWarn
+			ev.Message = fmt.Sprintf("%d installed package(s) have known vulnerabilities", len(vulns))
+			ev.Detail = strings.Join(lines, "\n")
+			ev.Data = map[string]any{"vulnerable": len(vulns), "packages": names}
+		case err != nil:
+			// pkg audit exits 1 only for vulnerabilities, which were
+			// matched above.
+			ev.Status = StatusWarn
+			ev.Message = "pkg audit could not run"
+			ev.Detail = tail(out+"\n"+err.Error(), 300)
+		default:
+			ev.Status = StatusOK
+			ev.Message = "No known vulnerabilities in installed packages"
+			ev.Data = map[string]any{"vulnerable": 0}
+		}
+		return eventMsg(ev)
+
+	case StagePkgClean:
+		return runAndReportWith(ctx, ev, "pkg", []string{"clean", "-a", "-y"},
+			"Package cache cleaned", "pkg clean reported problems", false, annotatePkgClean)
+
+	case StagePkgUpgrade:
+		return runAndReport(ctx, ev, "pkg", []string{"upgrade", "-y"},
+			"Packages upgraded", "pkg upgrade reported problems", false)
+
+	case StagePreHook:
+		return runHook(ctx, ev, cfg.PreHook, nil)
+
+	case StagePostHook:
+		return runHook(ctx, ev, cfg.PostHook, []string{"PPR_STATUS=" + string(cfg.RunStatus)})
+
+	case StageMoveLocalDB:
+		localDB := filepath.Join(pkgDBDir, "local.sqlite")
+		if fileExists(ctx, localDB) {
+			backup := backupName(localDB, time.Now(), func(p string) bool { return fileExists(ctx, p) })
+			ev.Data = map[string]any{"backup": backup}
+			if err := renameFile(ctx, localDB, backup); err != nil {
+				ev.Status = StatusWarn
+				ev.Message = "Could not move local.sqlite"
+				ev.Detail = err.Error()
+				return eventMsg(ev)
+			}
+			ev.Status = StatusOK
+			ev.Message = "Moved local.sqlite aside"
+			ev.Detail = localDB + " -> " + backup
+			if !cfg.Offline {
+				_, _ = runCmdCapture(ctx, "pkg", []string{"update", "-f"})
+			}
+			_, _ = runCmdCapture(ctx, "pkg", []string{"check", "-da"})
+			return eventMsg(ev)
+		}
+		// softened tone here
+		ev.Status = StatusOK
+		ev.Message = "No local.sqlite found"
+		ev.Detail = "Package database is already in a clean state"
+		return eventMsg(ev)
+
+	case StageRestore:
+		localDB := filepath.Join(pkgDBDir, "local.sqlite")
+		backup, err := latestBackup(ctx)
+		if err != nil {
+			ev.Status = StatusError
+			ev.Message = err.Error()
+			return eventMsg(ev)
+		}
+		ev.Data = map[string]any{"backup": backup}
+		if fileExists(ctx, localDB) && !cfg.Force {
+			ev.Status = StatusError
+			ev.Message = "local.sqlite exists; refusing to overwrite it without -force"
+			ev.Detail = "Would restore " + backup
+			return eventMsg(ev)
+		}
+		if err := renameFile(ctx, backup, localDB); err != nil {
+			ev.Status = StatusError
+			ev.Message = "Could not restore local.sqlite"
+			ev.Detail = err.Error()
+			return eventMsg(ev)
+		}
+		ev.Status = StatusOK
+		ev.Message = "Restored local.sqlite from " + filepath.Base(backup)
+		ev.Detail = backup + " -> " + localDB
+		return eventMsg(ev)
+	}
+	ev.Status = StatusSkip
+	ev.SkipReason = SkipNotApplicable
+	ev.Message = "No-op"
+	return eventMsg(ev)
+}
+
+var reBackupName = regexp.MustCompile(`^local\.sqlite(?:\.(\d{4}-\d\d-\d\dT\d\d-\d\d-\d\d))?(?:\.(\d+))?\.bak$`)
+
+// latestBackup finds the newest local.sqlite backup in the db dir, going by
+// the timestamp and counter backupName put in its name. An untimestamped
+// local.sqlite.bak from older releases counts as the oldest.
+func latestBackup(ctx context.Context) (string, error) {
+	paths, err := globFiles(ctx, filepath.Join(pkgDBDir, "local.sqlite*.bak"))
+	if err != nil {
+		return "", err
+	}
+	best, bestStamp, bestN := "", "", -1
+	for _, p := range paths {
+		m := reBackupName.FindStringSubmatch(filepath.Base(p))
+		if m == nil {
+			continue
+		}
+		n, _ := strconv.Atoi(m[2])
+		if best == "" || m[1] > bestStamp || (m[1] == bestStamp && n > bestN) {
+			best, bestStamp, bestN = p, m[1], n
+		}
+	}
+	if best == "" {
+		return "", fmt.Errorf("no local.sqlite backup found in %s", pkgDBDir)
+	}
+	return best, nil
+}
+
+// Run a command and map output to event
+func runAndReport(ctx context.Context, ev Event, name string, args []string, okMsg, warnMsg string, tryBootstrap bool) tea.Msg {
+	return runAndReportWith(ctx, ev, name, args, okMsg, warnMsg, tryBootstrap, nil)
+}
+
+// runAndReportWith is runAndReport with a hook that may refine the event
+// from the command's full (untruncated) output.
+func runAndReportWith(ctx context.Context, ev Event, name string, args []string, okMsg, warnMsg string, tryBootstrap bool, annotate func(out string, ev *Event)) tea.Msg {
+	stdout, stderr, err := runCmdCaptureSplit(ctx, name, args)
+	out := stdout + stderr
+	code := exitStatus(err)
+	ev.ExitCode = &code
+	if err != nil && tryBootstrap {
+		_, _ = runCmdCapture(ctx, "pkg", []string{"bootstrap", "-f"})
+		out2, err2 := runCmdCapture(ctx, name, args)
+		code2 := exitStatus(err2)
+		ev.ExitCode = &code2
+		ev.Attempts = 2
+		ev.Status = StatusWarn
+		ev.Message = warnMsg
+		ev.Detail = tail(out+"\n"+out2, 300) + fmt.Sprintf("\nexit=%d (first attempt exit=%d)", code2, code)
+		if annotate != nil {
+			annotate(out2, &ev)
+		}
+		return eventMsg(ev)
+	}
+	if err != nil {
+		ev.Status = StatusWarn
+		ev.Message = warnMsg
+		ev.Detail = tail(out+"\n"+err.Error(), 300) + fmt.Sprintf("\nexit=%d", code)
+		if annotate != nil {
+			annotate(out, &ev)
+		}
+		return eventMsg(ev)
+	}
+	ev.Status = StatusOK
+	ev.Message = okMsg
+	ev.Detail = tail(out, 200)
+	if warnings := stderrWarnings(stderr); len(warnings) > 0 {
+		// Exit 0 but pkg complained: "succeeded, but not really".
+		ev.Status = StatusWarn
+		ev.Message = okMsg + " with warnings"
+		ev.Detail = tail(strings.Join(warnings, "\n"), 300)
+	}
+	if annotate != nil {
+		annotate(out, &ev)
+	}
+	return eventMsg(ev)
+}
+
+var reStderrWarning = []*regexp.Regexp{
+	regexp.MustCompile(`(?i)\bwarning:`),
+	regexp.MustCompile(`(?i)repository .* cannot be opened`),
+	regexp.MustCompile(`(?i)unable to update repository`),
+}
+
+// stderrWarnings returns the stderr lines that look like warnings.
+func stderrWarnings(stderr string) []string {
+	var out []string
+	for _, line := range strings.Split(stderr, "\n") {
+		for _, re := range reStderrWarning {
+			if re.MatchString(line) {
+				out = append(out, strings.TrimSpace(line))
+				break
+			}
+		}
+	}
+	return out
+}
+
+var (
+	reProcessed   = regexp.MustCompile(`(\d+) packages processed`)
+	reIncremental = regexp.MustCompile(`(\d+) packages? updated, (\d+) removed and (\d+) added`)
+	reUpToDate    = regexp.MustCompile(`(?m)^(\S+) repository is up to date`)
+)
+
+// reAvailable matches the per-repository count in pkg stats -r.
+var reAvailable = regexp.MustCompile(`Packages available:\s*(\d+)`)
+
+// remotePackages counts the packages the catalog offers, summed over all
+// repositories. A broken catalog typically reports none.
+func remotePackages(ctx context.Context) (int, string, error) {
+	out, err := runCmdCapture(ctx, "pkg", []string{"stats", "-r"})
+	if err != nil {
+		return 0, out, err
+	}
+	total := 0
+	for _, m := range reAvailable.FindAllStringSubmatch(out, -1) {
+		n, _ := strconv.Atoi(m[1])
+		total += n
+	}
+	return total, out, nil
+}
+
+// reVulnerable matches each "name is vulnerable:" block of pkg audit,
+// capturing the package and the advisory's one-line summary after it.
+var reVulnerable = regexp.MustCompile(`(?m)^(\S+) is vulnerable:\s*\n\s*(.*)$`)
+
+// reCleanFreed matches pkg clean's "The cleanup will free 1 GiB" line.
+var reCleanFreed = regexp.MustCompile(`will free ([0-9.]+ ?[KMGTP]?i?B)`)
+
+// annotatePkgClean reports how much space pkg clean reclaimed.
+func annotatePkgClean(out string, ev *Event) {
+	switch m := reCleanFreed.FindStringSubmatch(out); {
+	case m != nil:
+		ev.Data = map[string]any{"freed": m[1]}
+		if ev.Status == StatusOK {
+			ev.Message = "Package cache cleaned, freed " + m[1]
+		}
+	case strings.Contains(out, "Nothing to do"):
+		ev.Data = map[string]any{"freed": "0 B"}
+		if ev.Status == StatusOK {
+			ev.Message = "Package cache already clean"
+		}
+	}
+}
+
+// annotatePkgUpdate records whether pkg update actually refreshed the
+// catalog or found every repository already up to date.
+func annotatePkgUpdate(out string, ev *Event) {
+	data := map[string]any{}
+	processed := 0
+	for _, m := range reProcessed.FindAllStringSubmatch(out, -1) {
+		n, _ := strconv.Atoi(m[1])
+		processed += n
+	}
+	var updated, removed, added int
+	for _, m := range reIncremental.FindAllStringSubmatch(out, -1) {
+		u, _ := strconv.Atoi(m[1])
+		r, _ := strconv.Atoi(m[2])
+		a, _ := strconv.Atoi(m[3])
+		updated, removed, added = updated+u, removed+r, added+a
+	}
+	var current []string
+	for _, m := range reUpToDate.FindAllStringSubmatch(out, -1) {
+		current = append(current, m[1])
+	}
+
+	changed := processed > 0 || updated+removed+added > 0
+	data["catalog_changed"] = changed
+	data["packages_processed"] = processed
+	if updated+removed+added > 0 {
+		data["updated"], data["removed"], data["added"] = updated, removed, added
+	}
+	if len(current) > 0 {
+		data["up_to_date"] = current
+	}
+	ev.Data = data
+
+	if ev.Status != StatusOK {
+		return
+	}
+	switch {
+	case updated+removed+added > 0:
+		ev.Message += fmt.Sprintf(": %d packages processed (%d updated, %d removed, %d added)", processed, updated, removed, added)
+	case processed > 0:
+		ev.Message += fmt.Sprintf(": %d packages processed, catalog refreshed", processed)
+	case len(current) > 0 || strings.Contains(out, "All repositories are up to date"):
+		ev.Message += ": catalog already up to date"
+	}
+}
+
+// checkCategories classifies pkg check problem lines. Each kind calls for
+// a different remedy, so they are counted separately.
+var checkCategories = []struct {
+	key   string
+	label string
+	re    *regexp.Regexp
+}{
+	{"missing_files", "missing files", regexp.MustCompile(`(?i)missing file`)},
+	{"checksum_mismatch", "checksum mismatches", regexp.MustCompile(`(?i)checksum mismatch`)},
+	{"missing_dependencies", "missing dependencies", regexp.MustCompile(`(?i)missing dependency|is missing a dependency`)},
+}
+
+// maxCheckExamples caps the sample lines kept per category.
+const maxCheckExamples = 3
+
+// annotatePkgCheck counts pkg check -da problems by category, keeping a
+// few example lines of each, and summarizes them in the message.
+func annotatePkgCheck(out string, ev *Event) {
+	counts := map[string]int{}
+	examples := map[string][]string{}
+	for _, line := range strings.Split(out, "\n") {
+		line = strings.TrimSpace(line)
+		for _, c := range checkCategories {
+			if c.re.MatchString(line) {
+				counts[c.key]++
+				if len(examples[c.key]) < maxCheckExamples {
+					examples[c.key] = append(examples[c.key], line)
+				}
+				break
+			}
+		}
+	}
+	if len(counts) == 0 {
+		return
+	}
+	data := map[string]any{"examples": examples}
+	var parts []string
+	for _, c := range checkCategories {
+		if n := counts[c.key]; n > 0 {
+			data[c.key] = n
+			parts = append(parts, fmt.Sprintf("%d %s", n, c.label))
+		}
+	}
+	ev.Data = data
+	if ev.Status == StatusOK {
+		ev.Status = StatusWarn
+		ev.Message = "Integrity issues detected"
+	}
+	ev.Message += ": " + strings.Join(parts, ", ")
+}
+
+// --- DNS check ---
+
+// dnsReport is the outcome of checkDNS.
+type dnsReport struct {
+	Message   string
+	Detail    string
+	OK        bool
+	AllFailed bool     // no host resolved at all
+	Hosts     []string // hostnames looked up
+	IPPinned  bool     // some repo is configured by IP literal
+	Addrs     map[string][]string
+	Latency   map[string]int64 // lookup time per host, in ms
+}
+
+// status maps the report to an event status. A DNS failure is a warning
+// unless --dns-severity says otherwise; when some repos are pinned to IP
+// literals, and so do not need DNS at all, it defaults to informational.
+// When nothing resolves the resolver itself is broken, which is an error.
+func (r dnsReport) status(severity Status) Status {
+	switch {
+	case r.OK:
+		return StatusOK
+	case severity != "":
+		return severity
+	case r.AllFailed:
+		return StatusError
+	case r.IPPinned:
+		return StatusInfo
+	default:
+		return StatusWarn
+	}
+}
+
+// checkDNS resolves every repository host. Hosts that are already IP
+// literals are not looked up.
+func checkDNS(ctx context.Context, cfg Config) dnsReport {
+	// Read resolv.conf
+	resolvPath := "/etc/resolv.conf"
+	data, err := os.ReadFile(resolvPath)
+	var nameservers []string
+	if err == nil {
+		sc := bufio.NewScanner(strings.NewReader(string(data)))
+		for sc.Scan() {
+			line := strings.TrimSpace(sc.Text())
+			if strings.HasPrefix(line, "nameserver") {
+				fields := strings.Fields(line)
+				if len(fields) >= 2 {
+					nameservers = append(nameservers, fields[1])
+				}
+			}
+		}
+	}
+
+	// Derive targets from the configured repos (repo URLs → hosts)
+	repos, errRepos := configuredRepos(ctx, cfg)
+	var hosts, literals []string
+	seen := map[string]bool{}
+	if errRepos == nil {
+		for _, r := range repos {
+			if r.Disabled {
+				continue
+			}
+			if pu, err := url.Parse(r.URL); err == nil && pu.Host != "" {
+				h := pu.Hostname()
+				if net.ParseIP(h) != nil {
+					if !seen[h] {
+						seen[h] = true
+						literals = append(literals, h)
+					}
+					continue
+				}
+				if !seen[h] {
+					seen[h] = true
+					hosts = append(hosts, h)
+				}
+			}
+		}
+	}
+	// Add common defaults if none parsed
+	if len(hosts) == 0 && len(literals) == 0 {
+		for _, h := range []string{"pkg.freebsd.org", "pkg.ghostbsd.org"} {
+			if !seen[h] {
+				seen[h] = true
+				hosts = append(hosts, h)
+			}
+		}
+	}
+
 	var lines []string
 	if len(nameservers) > 0 {
 		lines = append(lines, "Resolvers:")
@@ -442,159 +2393,2429 @@ func checkDNS(ctx context.Context) (string, string, bool) {
 		lines = append(lines, "Resolvers: (none detected in /etc/resolv.conf)")
 	}
 
-	okAll := true
+	okAll, resolved := true, 0
+	addrs := map[string][]string{}
+	latency := map[string]int64{}
 	lines = append(lines, "Lookups:")
+	for _, ip := range literals {
+		lines = append(lines, fmt.Sprintf("  [-] %s  (IP literal, lookup skipped)", ip))
+	}
 	for _, h := range hosts {
 		start := time.Now()
-		addrs, err := net.LookupHost(h)
+		found, err := net.DefaultResolver.LookupHost(ctx, h)
 		elapsed := time.Since(start)
+		latency[h] = elapsed.Milliseconds()
 		if err != nil {
 			okAll = false
-			lines = append(lines, fmt.Sprintf("  [x] %s  (lookup failed: %v)", h, err))
+			lines = append(lines, fmt.Sprintf("  [x] %s  (lookup failed after %s: %v)", h, elapsed.Truncate(time.Millisecond), err))
 			continue
 		}
-		lines = append(lines, fmt.Sprintf("  [✓] %s  (%d result(s), %s)", h, len(addrs), elapsed.Truncate(time.Millisecond)))
+		resolved++
+		addrs[h] = found
+		lines = append(lines, fmt.Sprintf("  [✓] %s  (%s, %s)", h, strings.Join(found, " "), elapsed.Truncate(time.Millisecond)))
+	}
+
+	r := dnsReport{
+		Detail:    strings.Join(lines, "\n"),
+		OK:        okAll,
+		AllFailed: len(hosts) > 0 && resolved == 0 && len(literals) == 0,
+		Hosts:     hosts,
+		IPPinned:  len(literals) > 0,
+		Addrs:     addrs,
+		Latency:   latency,
+	}
+	switch {
+	case okAll:
+		r.Message = "DNS resolution working"
+	case r.AllFailed:
+		r.Message = "No repository host resolves; check the nameservers in " + resolvPath
+	case r.IPPinned:
+		r.Message = "Some DNS lookups failed (IP-pinned repositories do not need DNS)"
+	default:
+		r.Message = "Some DNS lookups failed"
+	}
+	return r
+}
+
+// targetDescription names the system being repaired when it is not simply
+// this host.
+func targetDescription(cfg Config) string {
+	var parts []string
+	if cfg.Remote != "" {
+		parts = append(parts, "remote host "+cfg.Remote)
+	}
+	if jailName != "" {
+		parts = append(parts, "jail "+jailName)
+	}
+	if rootDir != "" {
+		parts = append(parts, "root directory "+rootDir)
+	}
+	return strings.Join(parts, ", ")
+}
+
+// runningPkg lists other pkg processes ("pid name"). Repairing while one
+// holds the database would race it and misreport its lock as damage.
+func runningPkg(ctx context.Context) []string {
+	out, err := runCmdCapture(ctx, "pgrep", []string{"-lx", "pkg|pkg-static"})
+	if err != nil {
+		return nil
+	}
+	var procs []string
+	for _, line := range strings.Split(out, "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			procs = append(procs, line)
+		}
+	}
+	if len(procs) > 0 && fileExists(ctx, filepath.Join(pkgDBDir, "local.sqlite-journal")) {
+		procs = append(procs, "local.sqlite-journal present: a database transaction is in progress")
+	}
+	return procs
+}
+
+// blocksRun reports whether ev means the remaining stages must not run.
+func blocksRun(ev Event) bool {
+	return ev.Stage == StagePkgLock && ev.Status == StatusError
+}
+
+// --- OS detection ---
+
+// ghostbsdRepoConfs are where GhostBSD ships its pkg repository config.
+var ghostbsdRepoConfs = []string{"/etc/pkg/GhostBSD.conf", "/usr/local/etc/pkg/repos/GhostBSD.conf"}
+
+// osReleasePath and freebsdVersion are where detectOS learns the OS;
+// useRootDir moves them inside --rootdir so the root is described, not the
+// host.
+var (
+	osReleasePath  = "/etc/os-release"
+	freebsdVersion = "freebsd-version"
+)
+
+// osInfo is what StageDetectEnv learned about the system being repaired.
+type osInfo struct {
+	Name          string
+	Version       string
+	GhostBSDRepos string // the GhostBSD repo config found, if any
+}
+
+func (o osInfo) detail() string {
+	var lines []string
+	if o.Name != "" {
+		lines = append(lines, "OS: "+strings.TrimSpace(o.Name+" "+o.Version))
+	} else {
+		lines = append(lines, "OS: unknown (no /etc/os-release or freebsd-version)")
+	}
+	if o.GhostBSDRepos != "" {
+		lines = append(lines, "GhostBSD repo config: "+o.GhostBSDRepos)
+	} else {
+		lines = append(lines, "GhostBSD repo config: not present")
+	}
+	return strings.Join(lines, "\n")
+}
+
+func (o osInfo) data() map[string]any {
+	return map[string]any{"os_name": o.Name, "os_version": o.Version, "ghostbsd_repo_config": o.GhostBSDRepos}
+}
+
+// detectOS reads the distribution from /etc/os-release, falling back to
+// freebsd-version(1) on systems without it.
+func detectOS(ctx context.Context) osInfo {
+	var info osInfo
+	if data, err := readFile(ctx, osReleasePath); err == nil {
+		for _, line := range strings.Split(string(data), "\n") {
+			k, v, ok := strings.Cut(strings.TrimSpace(line), "=")
+			if !ok {
+				continue
+			}
+			v = strings.Trim(v, `"'`)
+			switch k {
+			case "NAME":
+				info.Name = v
+			case "VERSION", "VERSION_ID":
+				if info.Version == "" || k == "VERSION" {
+					info.Version = v
+				}
+			}
+		}
+	}
+	if info.Name == "" {
+		if out, err := runCmdCapture(ctx, freebsdVersion, nil); err == nil && strings.TrimSpace(out) != "" {
+			info.Name, info.Version = "FreeBSD", strings.TrimSpace(out)
+		}
+	}
+	for _, p := range ghostbsdRepoConfs {
+		if fileExists(ctx, p) {
+			info.GhostBSDRepos = p
+			break
+		}
+	}
+	return info
+}
+
+// --- pkg self-check ---
+
+// verifyPkgSelf makes sure pkg itself is sane before we trust it to repair
+// anything else: the binary runs, its config loads, and the files of the
+// pkg package match their recorded checksums.
+func verifyPkgSelf(ctx context.Context) (string, string, bool) {
+	var lines []string
+	version, err := runCmdCapture(ctx, "pkg", []string{"--version"})
+	if err != nil {
+		return "pkg binary does not run; reinstall it with pkg bootstrap -f",
+			tail(version+"\n"+err.Error(), 300), false
+	}
+	lines = append(lines, "pkg version: "+strings.TrimSpace(version))
+
+	abi, err := runCmdCapture(ctx, "pkg", []string{"config", "ABI"})
+	if err != nil {
+		return "pkg config is unusable; reinstall pkg with pkg bootstrap -f before repairing",
+			tail(abi+"\n"+err.Error(), 300), false
+	}
+	lines = append(lines, "ABI: "+strings.TrimSpace(abi))
+
+	out, err := runCmdCapture(ctx, "pkg", []string{"check", "-s", "pkg"})
+	if err != nil {
+		lines = append(lines, tail(out, 300))
+		return "pkg itself appears corrupt; run pkg bootstrap -f before repairing",
+			strings.Join(lines, "\n"), false
+	}
+	lines = append(lines, "Checksums of the pkg package verified")
+	return "pkg is intact", strings.Join(lines, "\n"), true
+}
+
+// pkgKeysDir holds the fingerprints pkg verifies repository signatures with.
+var pkgKeysDir = "/usr/share/keys/pkg"
+
+// checkKeysPerms looks for fingerprint directories and files pkg cannot
+// read. When that happens pkg fails signature verification without saying
+// why, which typically follows a restore that lost ownership or modes.
+func checkKeysPerms(dir string) (string, string, bool) {
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		// Nothing to chown; the keys themselves are gone.
+		return "pkg keys directory missing; reinstall pkg", dir + " does not exist", false
+	}
+	paths := []string{dir}
+	for _, sub := range []string{"trusted", "revoked"} {
+		p := filepath.Join(dir, sub)
+		paths = append(paths, p)
+		entries, err := os.ReadDir(p)
+		if err != nil {
+			continue
+		}
+		for _, e := range entries {
+			paths = append(paths, filepath.Join(p, e.Name()))
+		}
+	}
+
+	var problems []string
+	checked := 0
+	for _, p := range paths {
+		fi, err := os.Stat(p)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			problems = append(problems, err.Error())
+			continue
+		}
+		checked++
+		if msg := keyPermProblem(fi); msg != "" {
+			problems = append(problems, fmt.Sprintf("%s: %s (mode %s, owner %s)", p, msg, fi.Mode().Perm(), fileOwner(fi)))
+		}
+	}
+	if len(problems) > 0 {
+		problems = append(problems, "Restore with: chown -R root:wheel "+dir+" && chmod -R u=rwX,go=rX "+dir)
+		return fmt.Sprintf("%d pkg key path(s) have bad ownership or permissions", len(problems)-1),
+			strings.Join(problems, "\n"), false
+	}
+	return "pkg keys are readable", fmt.Sprintf("Checked %d path(s) under %s", checked, dir), true
+}
+
+// keyPermProblem describes what is wrong with one keys entry, or returns "".
+// Keys must be root-owned, readable by everyone (pkg drops privileges for
+// some operations) and not writable by anyone but root.
+func keyPermProblem(fi os.FileInfo) string {
+	perm := fi.Mode().Perm()
+	want := os.FileMode(0o444)
+	if fi.IsDir() {
+		want = 0o555
+	}
+	switch {
+	case perm&want != want:
+		return "not readable by pkg"
+	case perm&0o022 != 0:
+		return "writable by group or others"
+	}
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok && st.Uid != 0 {
+		return "not owned by root"
+	}
+	return ""
+}
+
+// fileOwner renders the uid:gid of a file for diagnostics.
+func fileOwner(fi os.FileInfo) string {
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		return fmt.Sprintf("%d:%d", st.Uid, st.Gid)
+	}
+	return "unknown"
+}
+
+// smokeTest proves the repaired catalog is usable end to end by resolving
+// a package from the remote repositories. pkg rquery refreshes the catalog
+// first if needed and never installs anything.
+func smokeTest(ctx context.Context, name string) (string, string, bool) {
+	out, err := runCmdCapture(ctx, "pkg", []string{"rquery", "%n-%v (%R)", name})
+	if err != nil {
+		return "Catalog is not usable: pkg rquery " + name + " failed", tail(out+"\n"+err.Error(), 300), false
+	}
+	found := strings.TrimSpace(out)
+	if found == "" {
+		return "Catalog is not usable: " + name + " not found in any repository",
+			"pkg rquery returned nothing; the catalog may be empty or stale", false
+	}
+	return "Catalog is usable: resolved " + name, found, true
+}
+
+// checkInstalledABI compares the system ABI with the ABI installed packages
+// were built for. After a major freebsd-update without reinstalling
+// packages the two diverge and pkg update behaves confusingly.
+func checkInstalledABI(ctx context.Context) (string, string, bool) {
+	abi, err := runCmdCapture(ctx, "pkg", []string{"config", "ABI"})
+	if err != nil {
+		return "Could not read pkg ABI", tail(abi+"\n"+err.Error(), 300), false
+	}
+	abi = strings.TrimSpace(abi)
+	out, err := runCmdCapture(ctx, "pkg", []string{"query", "%q"})
+	if err != nil {
+		return "Could not query installed packages", tail(out+"\n"+err.Error(), 300), false
+	}
+
+	counts := map[string]int{}
+	total, mismatched := 0, 0
+	for _, line := range strings.Split(out, "\n") {
+		pkgABI := strings.TrimSpace(line)
+		if pkgABI == "" {
+			continue
+		}
+		total++
+		if !abiCompatible(abi, pkgABI) {
+			mismatched++
+			counts[pkgABI]++
+		}
+	}
+	if total == 0 {
+		return "No installed packages to compare", "System ABI: " + abi, true
+	}
+	if mismatched == 0 {
+		return "Installed packages match the system ABI", fmt.Sprintf("System ABI: %s (%d packages checked)", abi, total), true
+	}
+
+	lines := []string{"System ABI: " + abi}
+	others := make([]string, 0, len(counts))
+	for a := range counts {
+		others = append(others, a)
+	}
+	sort.Strings(others)
+	for _, a := range others {
+		lines = append(lines, fmt.Sprintf("  %d package(s) built for %s", counts[a], a))
+	}
+	lines = append(lines, "Packages may need reinstalling for the new major version: pkg upgrade -f")
+	return fmt.Sprintf("%d of %d installed packages were built for a different ABI", mismatched, total),
+		strings.Join(lines, "\n"), false
+}
+
+// abiCompatible compares OS:major:arch ABIs, treating a "*" arch (noarch
+// packages) as matching any architecture.
+func abiCompatible(system, pkgABI string) bool {
+	if system == pkgABI {
+		return true
+	}
+	s := strings.Split(system, ":")
+	p := strings.Split(pkgABI, ":")
+	if len(s) != 3 || len(p) != 3 {
+		return false
+	}
+	return strings.EqualFold(s[0], p[0]) && s[1] == p[1] && (p[2] == "*" || s[2] == p[2])
+}
+
+// --- System facts ---
+
+// collectSystemFacts gathers a small, cheap set of host facts that help
+// correlate repair outcomes across a fleet. Every probe is read-only.
+func collectSystemFacts(ctx context.Context, cfg Config) (map[string]any, string) {
+	facts := map[string]any{}
+
+	if out, err := runCmdCapture(ctx, "sysctl", []string{"-n", "kern.osreldate"}); err == nil {
+		facts["kern.osreldate"] = strings.TrimSpace(out)
+	}
+
+	_, err := runCmdCapture(ctx, "route", []string{"-n", "get", "default"})
+	facts["default_route"] = err == nil
+
+	facts["local_unbound_running"] = fileExists(ctx, "/var/run/local_unbound.pid")
+
+	if data, err := readFile(ctx, "/etc/resolv.conf"); err == nil {
+		n := 0
+		for _, line := range strings.Split(string(data), "\n") {
+			if strings.HasPrefix(strings.TrimSpace(line), "nameserver") {
+				n++
+			}
+		}
+		facts["nameservers"] = n
+	}
+
+	if repos, err := configuredRepos(ctx, cfg); err == nil {
+		facts["configured_repos"] = len(repos)
+	}
+
+	keys := make([]string, 0, len(facts))
+	for k := range facts {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var lines []string
+	for _, k := range keys {
+		lines = append(lines, fmt.Sprintf("%s: %v", k, facts[k]))
+	}
+	return facts, strings.Join(lines, "\n")
+}
+
+// --- Repository Network Check ---
+
+// netReport is the outcome of checkRepoNetwork.
+type netReport struct {
+	Message string
+	Lines   []string
+	OK      bool
+	Broken  []string // repos that failed outright
+	// ABIMismatch are broken repos whose mirror lacks our ABI directory.
+	ABIMismatch []string
+	// NoCatalog are repos that serve meta.conf but no catalog archive.
+	NoCatalog []string
+	// Branches maps each probed repo to its quarterly/latest branch, and
+	// StaleQuarterly lists the repos whose quarterly branch is down while
+	// latest answers.
+	Branches       map[string]string
+	StaleQuarterly []string
+	Timings        []repoTiming // probed repos, in probe order
+}
+
+type repoTiming struct {
+	Name    string
+	Elapsed time.Duration
+}
+
+func (r netReport) detail() string {
+	lines := r.Lines
+	if len(r.Timings) > 1 {
+		lines = append(append([]string{}, lines...), timingChart(r.Timings)...)
+	}
+	return strings.Join(lines, "\n")
+}
+
+func (r netReport) data() map[string]any {
+	if len(r.Timings) == 0 {
+		return nil
+	}
+	ms := map[string]int64{}
+	for _, t := range r.Timings {
+		ms[t.Name] = t.Elapsed.Milliseconds()
+	}
+	data := map[string]any{"latency_ms": ms}
+	if len(r.ABIMismatch) > 0 {
+		data["abi_mismatch"] = r.ABIMismatch
+	}
+	if len(r.NoCatalog) > 0 {
+		data["no_catalog"] = r.NoCatalog
+	}
+	if len(r.Branches) > 0 {
+		data["branches"] = r.Branches
+	}
+	if len(r.StaleQuarterly) > 0 {
+		data["stale_quarterly"] = r.StaleQuarterly
+	}
+	return data
+}
+
+// checkRepoNetwork probes each configured repository.
+func checkRepoNetwork(ctx context.Context, cfg Config) netReport {
+	repos, err := configuredRepos(ctx, cfg)
+	if err != nil {
+		if cfg.RepoConf != "" {
+			return netReport{Message: "Could not read " + cfg.RepoConf, Lines: []string{err.Error()}}
+		}
+		return netReport{Message: "Could not run pkg -vv", Lines: []string{err.Error()}}
+	}
+	if len(repos) == 0 {
+		src := "pkg -vv output"
+		if cfg.RepoConf != "" {
+			src = cfg.RepoConf
+		}
+		return netReport{Message: "Could not detect repository URLs", Lines: []string{"No url entries parsed from " + src}}
+	}
+
+	results := probeAll(ctx, cfg, repos)
+
+	var r netReport
+	okAll := true
+	slow := false
+	degraded := false
+	// Each repo's lines, slowest probe first so a crawling mirror tops the
+	// list; repos that were not probed keep their order at the end.
+	type entry struct {
+		lines   []string
+		elapsed time.Duration
+	}
+	var entries []entry
+	for i, repo := range repos {
+		if repo.Disabled {
+			entries = append(entries, entry{lines: []string{fmt.Sprintf("[skip] %s (disabled)", repo.Name)}})
+			continue
+		}
+		if cfg.RepoRegex != nil && !cfg.RepoRegex.MatchString(repo.Name) {
+			entries = append(entries, entry{lines: []string{fmt.Sprintf("[skip] %s (does not match --repo-regex)", repo.Name)}})
+			continue
+		}
+		st, info, elapsed := results[i].status, results[i].info, results[i].elapsed
+		r.Timings = append(r.Timings, repoTiming{Name: repo.Name, Elapsed: elapsed})
+		if b := repo.branch(); b != "" {
+			if r.Branches == nil {
+				r.Branches = map[string]string{}
+			}
+			r.Branches[repo.Name] = b
+			info += "; branch: " + b
+		}
+		e := entry{elapsed: elapsed}
+		switch {
+		case st == StatusError:
+			e.lines = append(e.lines, "[x] "+info)
+			if results[i].branchHint != "" {
+				e.lines = append(e.lines, "    "+results[i].branchHint)
+				r.StaleQuarterly = append(r.StaleQuarterly, repo.Name)
+			}
+			if results[i].abiHint != "" {
+				e.lines = append(e.lines, "    "+results[i].abiHint)
+				r.ABIMismatch = append(r.ABIMismatch, repo.Name)
+			}
+			r.Broken = append(r.Broken, repo.Name)
+			okAll = false
+		case st == StatusWarn:
+			e.lines = append(e.lines, "[!] "+info)
+			if results[i].noCatalog {
+				r.NoCatalog = append(r.NoCatalog, repo.Name)
+			}
+			degraded = true
+		case st == StatusSkip:
+			e.lines = append(e.lines, "[skip] "+info)
+		case cfg.SlowMirror > 0 && elapsed > cfg.SlowMirror:
+			// Reachable, but slow enough that pkg update will crawl.
+			e.lines = append(e.lines, fmt.Sprintf("[!] %s; reachable but slow (%d ms)", info, elapsed.Milliseconds()))
+			slow = true
+		default:
+			e.lines = append(e.lines, "[✓] "+info)
+		}
+		entries = append(entries, e)
+	}
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].elapsed > entries[j].elapsed })
+	for _, e := range entries {
+		r.Lines = append(r.Lines, e.lines...)
+	}
+	switch {
+	case len(r.Timings) == 0 && cfg.RepoRegex == nil:
+		r.Message = "No enabled repositories to probe"
+		r.OK = true
+	case len(r.Timings) == 0:
+		r.Message = "No repositories matched --repo-regex"
+	case len(r.ABIMismatch) > 0:
+		r.Message = "Some mirrors have no packages for this ABI"
+	case len(r.StaleQuarterly) > 0:
+		r.Message = "The quarterly branch is unreachable, but latest is up"
+	case !okAll:
+		r.Message = "Some repositories are unreachable"
+	case len(r.NoCatalog) > 0:
+		r.Message = "Some mirrors serve meta.conf but no package catalog"
+	case degraded:
+		r.Message = "Some repositories are degraded or temporarily unavailable"
+	case slow:
+		r.Message = "Some repositories are reachable but slow"
+	default:
+		r.Message = "Repository network reachable"
+		r.OK = true
+	}
+	return r
+}
+
+// maxProbeWorkers bounds how many repositories are probed at once.
+const maxProbeWorkers = 8
+
+type probeResult struct {
+	status   Status
+	info     string
+	elapsed  time.Duration
+	attempts int
+	abiHint  string // set when the mirror lacks the ABI directory
+	// branchHint suggests latest when the quarterly branch is down.
+	branchHint string
+	// noCatalog is set by --deep-check when meta.conf is served but no
+	// packagesite archive is.
+	noCatalog bool
+}
+
+// probeBackoff is the wait before the first probe retry; it doubles for
+// each one after.
+const probeBackoff = 500 * time.Millisecond
+
+// probeAll probes the repos matching --repo-regex concurrently, so the
+// stage takes about as long as the slowest probe. Results are indexed
+// like repos to keep the report in configuration order.
+func probeAll(ctx context.Context, cfg Config, repos []Repo) []probeResult {
+	results := make([]probeResult, len(repos))
+	sem := make(chan struct{}, maxProbeWorkers)
+	var wg sync.WaitGroup
+	for i, repo := range repos {
+		if repo.Disabled || cfg.RepoRegex != nil && !cfg.RepoRegex.MatchString(repo.Name) {
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			var res probeResult
+			var start time.Time
+			wait := probeBackoff
+			for {
+				res.attempts++
+				start = time.Now()
+				if cfg.ProbeViaPkg {
+					res.status, res.info = probeRepoViaPkg(ctx, repo)
+				} else {
+					res.status, res.info = probeRepo(ctx, repo.URL)
+				}
+				// A blip should not condemn a good mirror, but retries
+				// must not outlive the stage.
+				if res.status != StatusError || res.attempts > cfg.ProbeRetries || !fitsDeadline(ctx, wait) {
+					break
+				}
+				select {
+				case <-time.After(wait):
+				case <-ctx.Done():
+				}
+				if ctx.Err() != nil {
+					break
+				}
+				wait *= 2
+			}
+			res.elapsed = time.Since(start)
+			if res.attempts > 1 {
+				res.info += fmt.Sprintf(" after %d attempts", res.attempts)
+			}
+			if cfg.DeepCheck && res.status == StatusOK {
+				found, ok := checkCatalog(ctx, repo.URL)
+				res.info += "; catalog: " + found
+				if !ok {
+					res.status, res.noCatalog = StatusWarn, true
+				}
+			}
+			if res.status == StatusError && repo.ABIBase != "" {
+				res.abiHint = checkABIDir(ctx, repo)
+			}
+			if res.status == StatusError && repo.branch() == "quarterly" {
+				latest := repo.withBranch("latest")
+				var st Status
+				if cfg.ProbeViaPkg {
+					st, _ = probeRepoViaPkg(ctx, latest)
+				} else {
+					st, _ = probeRepo(ctx, latest.URL)
+				}
+				if st == StatusOK {
+					res.branchHint = "quarterly is unreachable but " + latest.URL +
+						" responds; consider switching this repo to latest"
+				}
+			}
+			results[i] = res
+		}()
+	}
+	wg.Wait()
+	return results
+}
+
+// branch is the repo's package branch, the path component after the ABI:
+// quarterly, latest or a site-specific name. It is empty when the URL has
+// no ${ABI}.
+func (r Repo) branch() string {
+	if r.ABIBase == "" {
+		return ""
+	}
+	rest := strings.Trim(strings.TrimPrefix(r.URL, r.ABIBase+r.ABI), "/")
+	b, _, _ := strings.Cut(rest, "/")
+	return b
+}
+
+// withBranch returns r pointed at another branch of the same mirror.
+func (r Repo) withBranch(b string) Repo {
+	cur := r.branch()
+	if cur == "" {
+		return r
+	}
+	prefix := r.ABIBase + r.ABI + "/"
+	r.URL = prefix + b + strings.TrimPrefix(strings.TrimPrefix(r.URL, prefix), cur)
+	return r
+}
+
+// setBranch points every enabled repo on another branch at cfg.SetBranch
+// by rewriting its url in the config file that defines it, after backing
+// the file up. Nothing is written unless every new URL answers; with dry
+// set nothing is written at all and the message says what would change.
+func setBranch(ctx context.Context, cfg Config, dry bool) (Status, string, string, map[string]any) {
+	repos, err := configuredRepos(ctx, cfg)
+	if err != nil {
+		return StatusError, "Could not read the repository configuration", err.Error(), nil
+	}
+	type change struct {
+		repo Repo
+		file string
+		from string
+	}
+	var changes []change
+	var lines []string
+	for _, r := range repos {
+		b := r.branch()
+		if r.Disabled || b == "" || b == cfg.SetBranch {
+			continue
+		}
+		file := repoConfFile(cfg, []string{r.Name})
+		if file == "" {
+			return StatusError, "Could not find the config file for " + r.Name, "", nil
+		}
+		next := r.withBranch(cfg.SetBranch)
+		if st, info := probeRepo(ctx, next.URL); st != StatusOK {
+			return StatusError, fmt.Sprintf("Not switching: the %s branch of %s is not reachable", cfg.SetBranch, r.Name), info, nil
+		}
+		changes = append(changes, change{r, file, b})
+		lines = append(lines, fmt.Sprintf("%s (%s): %s -> %s", r.Name, file, r.URL, next.URL))
+	}
+	if len(changes) == 0 {
+		return StatusOK, "Every repository is already on " + cfg.SetBranch, "", nil
+	}
+	if dry {
+		return StatusOK, fmt.Sprintf("would switch %d repo(s) to %s", len(changes), cfg.SetBranch), strings.Join(lines, "\n"), nil
+	}
+	// Every file is rewritten in memory first, so a repo whose url cannot
+	// be found leaves all of them untouched.
+	contents := map[string]string{}
+	var files []string
+	for _, c := range changes {
+		conf, ok := contents[c.file]
+		if !ok {
+			data, err := os.ReadFile(c.file)
+			if err != nil {
+				return StatusError, "Could not read " + c.file, err.Error(), nil
+			}
+			conf = string(data)
+			files = append(files, c.file)
+		}
+		conf, n := rewriteBranch(conf, c.repo.Name, c.from, cfg.SetBranch)
+		if n == 0 {
+			return StatusError, "Could not find the url of " + c.repo.Name + " in " + c.file, "", nil
+		}
+		contents[c.file] = conf
+	}
+	backups := map[string]string{}
+	for _, f := range files {
+		b, err := backupFile(f)
+		if err != nil {
+			return StatusError, "Could not back up " + f, err.Error(), nil
+		}
+		backups[f] = b
+		lines = append(lines, "backup: "+b)
+	}
+	for i, f := range files {
+		if err := replaceFile(f, []byte(contents[f])); err != nil {
+			// Put back the files already switched so no repo is left on
+			// the new branch while the others are not.
+			msg, detail := "Could not write "+f+"; no repository was switched", err.Error()
+			for _, done := range files[:i] {
+				data, rerr := os.ReadFile(backups[done])
+				if rerr == nil {
+					rerr = replaceFile(done, data)
+				}
+				if rerr != nil {
+					msg = "Could not write " + f + " nor restore the files already switched"
+					detail += fmt.Sprintf("\ncould not restore %s from %s: %v", done, backups[done], rerr)
+				}
+			}
+			return StatusError, msg, detail, nil
+		}
+	}
+	return StatusOK, fmt.Sprintf("Switched %d repo(s) to %s", len(changes), cfg.SetBranch),
+		strings.Join(lines, "\n"), map[string]any{"branch": cfg.SetBranch, "backups": backups}
+}
+
+// rewriteBranch switches the url lines of the named repo block in a pkg
+// repo config from one branch to another, returning the new text and how
+// many urls changed.
+func rewriteBranch(conf, name, from, to string) (string, int) {
+	lines := strings.Split(conf, "\n")
+	block, n := "", 0
+	for i, ln := range lines {
+		line := strings.TrimSpace(ln)
+		if strings.HasSuffix(line, "{") {
+			block = strings.Trim(strings.TrimSuffix(strings.TrimSpace(strings.TrimSuffix(line, "{")), ":"), `"'`)
+			continue
+		}
+		if block != name || !reURLKey.MatchString(line) {
+			continue
+		}
+		if r := strings.Replace(ln, "${ABI}/"+from, "${ABI}/"+to, 1); r != ln {
+			lines[i] = r
+			n++
+		}
+	}
+	return strings.Join(lines, "\n"), n
+}
+
+// knownMirrors are the public mirrors --suggest-mirror ranks alongside the
+// configured repos, keyed by the repo name they would replace.
+var knownMirrors = map[string][]string{
+	"FreeBSD": {
+		"https://pkg.freebsd.org/${ABI}/quarterly",
+		"https://pkg0.nyi.freebsd.org/${ABI}/quarterly",
+		"https://pkg0.bme.freebsd.org/${ABI}/quarterly",
+		"https://pkg0.kul.freebsd.org/${ABI}/quarterly",
+	},
+	"GhostBSD": {
+		"https://pkg.ghostbsd.org/stable/${ABI}/latest",
+	},
+}
+
+// template is the repo URL with ${ABI} put back, as it would be written in
+// a repo config.
+func (r Repo) template() string {
+	if r.ABIBase == "" {
+		return r.URL
+	}
+	return r.ABIBase + "${ABI}" + strings.TrimPrefix(r.URL, r.ABIBase+r.ABI)
+}
+
+// suggestMirror probes the configured repos and the known mirrors for this
+// OS, prints them ranked by reachability and latency, and recommends the
+// best as a repo config snippet. Nothing is written. It reports whether
+// any mirror was reachable.
+func suggestMirror(ctx context.Context, cfg Config, w io.Writer) bool {
+	abi, _ := runCmdCapture(ctx, "pkg", []string{"config", "ABI"})
+	abi = strings.TrimSpace(abi)
+	repos, _ := configuredRepos(ctx, cfg)
+	family := "FreeBSD"
+	if info := detectOS(ctx); info.GhostBSDRepos != "" || strings.Contains(info.Name, "GhostBSD") {
+		family = "GhostBSD"
+	}
+	p := repoParser{abi: abi}
+	p.feed(family + ": {")
+	for _, u := range knownMirrors[family] {
+		p.feed(`url: "` + u + `"`)
+	}
+	seen := map[string]bool{}
+	var candidates []Repo
+	for _, r := range append(repos, p.repos...) {
+		if !r.Disabled && !seen[r.URL] {
+			seen[r.URL] = true
+			candidates = append(candidates, r)
+		}
+	}
+
+	results := probeAll(ctx, cfg, candidates)
+	rank := map[Status]int{StatusOK: 0, StatusWarn: 1, StatusSkip: 2, StatusError: 3}
+	order := make([]int, 0, len(candidates))
+	for i := range candidates {
+		if results[i].attempts > 0 {
+			order = append(order, i)
+		}
+	}
+	sort.SliceStable(order, func(a, b int) bool {
+		ra, rb := results[order[a]], results[order[b]]
+		if rank[ra.status] != rank[rb.status] {
+			return rank[ra.status] < rank[rb.status]
+		}
+		return ra.elapsed < rb.elapsed
+	})
+	for _, i := range order {
+		fmt.Fprintf(w, "%s %6d ms  %s\n", statusIcon(results[i].status), results[i].elapsed.Milliseconds(), results[i].info)
+	}
+	if len(order) == 0 || results[order[0]].status != StatusOK {
+		fmt.Fprintln(w, "No mirror is reachable; check the network before choosing one.")
+		return false
+	}
+	best := candidates[order[0]]
+	fmt.Fprintf(w, "\nSuggested repository (for /usr/local/etc/pkg/repos/%s.conf):\n", best.Name)
+	fmt.Fprintf(w, "%s: {\n  url: \"pkg+%s\",\n  enabled: yes\n}\n", best.Name, best.template())
+	return true
+}
+
+// checkCatalog reports which catalog archives the repo at raw serves, and
+// whether a packagesite is among them: a mirror with meta.conf but no
+// catalog is exactly what makes pkg update fail.
+func checkCatalog(ctx context.Context, raw string) (string, bool) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "not checked", true
+	}
+	var found []string
+	site := false
+	// data.pkg only exists on repos built by newer pkg, so it is listed
+	// when present but not required.
+	for _, name := range append(catalogFiles, "data.pkg") {
+		ok := false
+		switch u.Scheme {
+		case "file":
+			ok = fileExists(ctx, filepath.Join(u.Path, name))
+		case "http", "https":
+			ok = targetHas(ctx, strings.TrimRight(raw, "/")+"/"+name)
+		default:
+			return "not checked", true
+		}
+		if ok {
+			found = append(found, name)
+			site = site || strings.HasPrefix(name, "packagesite.")
+		}
+	}
+	if !site {
+		return "no packagesite.pkg or packagesite.txz", false
+	}
+	return strings.Join(found, ", "), true
+}
+
+var reABIDir = regexp.MustCompile(`href="(?:\./)?([A-Za-z]+:[0-9]+:[A-Za-z0-9_*]+)/?"`)
+
+// checkABIDir explains a failed probe when the mirror itself is up but has
+// no directory for our ABI, as happens right after a major upgrade. It
+// lists the ABI directories the mirror does offer, when it shows an index.
+func checkABIDir(ctx context.Context, r Repo) string {
+	if !strings.HasPrefix(r.ABIBase, "http://") && !strings.HasPrefix(r.ABIBase, "https://") {
+		return ""
+	}
+	if targetHas(ctx, r.ABIBase+r.ABI+"/") {
+		return ""
+	}
+	body, ok := targetGet(ctx, r.ABIBase, 1<<20)
+	if !ok {
+		return ""
+	}
+	var avail []string
+	seen := map[string]bool{}
+	for _, m := range reABIDir.FindAllStringSubmatch(string(body), -1) {
+		if !seen[m[1]] {
+			seen[m[1]] = true
+			avail = append(avail, m[1])
+		}
+	}
+	hint := fmt.Sprintf("mirror is up but has no %s directory (ABI mismatch?)", r.ABI)
+	if len(avail) > 0 {
+		hint += "; available: " + strings.Join(avail, ", ")
+	}
+	return hint
+}
+
+// targetHas reports whether target answers with success from the machine
+// being repaired. Here that is a HEAD (or GET) from Go's client; a --remote
+// host or --jail sees the mirrors through its own network, so fetch -s asks
+// there for the size without downloading the file.
+func targetHas(ctx context.Context, target string) bool {
+	if hostLocal() {
+		client := &http.Client{
+			Timeout:   6 * time.Second,
+			Transport: &http.Transport{Proxy: http.ProxyFromEnvironment},
+		}
+		resp, _, err := headOrGet(ctx, client, target)
+		return err == nil && resp.StatusCode >= 200 && resp.StatusCode < 400
+	}
+	_, err := runCmdCapture(ctx, "fetch", []string{"-q", "-s", "-T", "15", target})
+	return err == nil
+}
+
+// targetGet GETs up to limit bytes of target from the machine being
+// repaired, like targetHas, reporting whether the server answered with
+// success.
+func targetGet(ctx context.Context, target string, limit int) ([]byte, bool) {
+	if hostLocal() {
+		client := &http.Client{
+			Timeout:   6 * time.Second,
+			Transport: &http.Transport{Proxy: http.ProxyFromEnvironment},
+		}
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+		if err != nil {
+			return nil, false
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return nil, false
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode >= 400 {
+			return nil, false
+		}
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, int64(limit)))
+		return body, true
+	}
+	out, _, err := runCmdCaptureSplit(ctx, "fetch", []string{"-q", "-T", "15", "-o", "-", target})
+	if err != nil {
+		return nil, false
+	}
+	return []byte(out[:min(len(out), limit)]), true
+}
+
+// timingChart renders probe times as ASCII bars, slowest first, so one
+// pathologically slow mirror stands out among healthy ones.
+func timingChart(timings []repoTiming) []string {
+	sorted := append([]repoTiming{}, timings...)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].Elapsed > sorted[j].Elapsed })
+	const width = 20
+	slowest := sorted[0].Elapsed
+	nameW := 0
+	for _, t := range sorted {
+		nameW = max(nameW, len(t.Name))
+	}
+	lines := []string{"Relative timing:"}
+	for _, t := range sorted {
+		n := width
+		if slowest > 0 {
+			n = int(int64(width) * int64(t.Elapsed) / int64(slowest))
+		}
+		lines = append(lines, fmt.Sprintf("  %-*s %-*s %d ms", nameW, t.Name, width, strings.Repeat("#", max(n, 1)), t.Elapsed.Milliseconds()))
+	}
+	return lines
+}
+
+// configuredRepos returns the repositories to check: those in
+// cfg.RepoConf when set (so a candidate config can be validated before it
+// is installed), otherwise whatever pkg -vv reports.
+func configuredRepos(ctx context.Context, cfg Config) ([]Repo, error) {
+	abi, _ := runCmdCapture(ctx, "pkg", []string{"config", "ABI"})
+	abi = strings.TrimSpace(abi)
+	if cfg.RepoConf != "" {
+		data, err := os.ReadFile(cfg.RepoConf)
+		if err != nil {
+			return nil, err
+		}
+		return parseRepos(stripConfComments(string(data)), abi), nil
+	}
+	return streamRepos(ctx, abi)
+}
+
+var repoConfGlobs = []string{
+	"/etc/pkg/*.conf",
+	"/usr/local/etc/pkg/repos/*.conf",
+}
+
+// repoConfFile returns the config file that defines the first of the named
+// repos, or cfg.RepoConf when one was given explicitly. Under --rootdir the
+// files are looked for inside the root, where pkg -c reads them.
+func repoConfFile(cfg Config, names []string) string {
+	if cfg.RepoConf != "" {
+		return cfg.RepoConf
+	}
+	for _, name := range names {
+		if name == "" {
+			continue
+		}
+		re := regexp.MustCompile(`^\s*"?` + regexp.QuoteMeta(name) + `"?\s*:?\s*\{`)
+		for _, g := range repoConfGlobs {
+			files, _ := filepath.Glob(filepath.Join(rootDir, g))
+			for _, f := range files {
+				data, err := os.ReadFile(f)
+				if err != nil {
+					continue
+				}
+				for _, line := range strings.Split(string(data), "\n") {
+					if re.MatchString(line) {
+						return f
+					}
+				}
+			}
+		}
+	}
+	return ""
+}
+
+// stripConfComments drops '#' and '//' comments from a pkg repo config,
+// leaving URLs such as "pkg+http://..." intact.
+func stripConfComments(conf string) string {
+	var b strings.Builder
+	for _, line := range strings.Split(conf, "\n") {
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		if t := strings.TrimSpace(line); strings.HasPrefix(t, "//") {
+			line = ""
+		}
+		b.WriteString(line)
+		b.WriteByte('\n')
+	}
+	return b.String()
+}
+
+// parseRepos extracts repository blocks ("Name: {" ... "}") and their url
+// entries from pkg -vv output.
+func parseRepos(vv, abi string) []Repo {
+	p := repoParser{abi: abi}
+	for _, ln := range strings.Split(vv, "\n") {
+		p.feed(ln)
+	}
+	return p.repos
+}
+
+// reURLKey matches an explicit url key however it is spaced or quoted
+// (url: "...", url             : "...", "url" = ...), capturing the value
+// after the first key/value separator.
+var reURLKey = regexp.MustCompile(`^"?url"?\s*[:=]\s*(.*)$`)
+
+// reEnabledKey matches a repo block's enabled flag, e.g. enabled: no.
+var reEnabledKey = regexp.MustCompile(`^"?enabled"?\s*[:=]\s*"?(\w+)"?`)
+
+// repoParser turns pkg -vv / repo config text into Repos one line at a
+// time, so output can be parsed as it streams in.
+type repoParser struct {
+	abi   string
+	name  string
+	repos []Repo
+	// block is the index in repos of the current block's first url, so
+	// an enabled flag can apply to urls that came before it; disabled
+	// carries it to urls that come after.
+	block    int
+	disabled bool
+}
+
+func (p *repoParser) feed(ln string) {
+	line := strings.TrimSpace(ln)
+	if strings.HasSuffix(line, "{") {
+		name := strings.TrimSuffix(strings.TrimSpace(strings.TrimSuffix(line, "{")), ":")
+		p.name = strings.Trim(name, `"'`)
+		p.block = len(p.repos)
+		p.disabled = false
+		return
+	}
+	if m := reEnabledKey.FindStringSubmatch(line); m != nil {
+		switch strings.ToLower(m[1]) {
+		case "no", "false", "off":
+			for i := p.block; i < len(p.repos); i++ {
+				p.repos[i].Disabled = true
+			}
+			p.disabled = true
+		default:
+			p.disabled = false
+		}
+		return
+	}
+	m := reURLKey.FindStringSubmatch(line)
+	if m == nil {
+		return
+	}
+	u := strings.TrimRight(m[1], ",")
+	u = strings.Trim(u, `"'`)
+	u = strings.TrimSpace(u)
+	// pkg+http, pkg+https, pkg+file, pkg+ftp, ... → plain scheme
+	u = strings.TrimPrefix(u, "pkg+")
+	repo := Repo{Name: p.name, Disabled: p.disabled}
+	if base, _, ok := strings.Cut(u, "${ABI}"); ok && p.abi != "" {
+		repo.ABIBase, repo.ABI = base, p.abi
+	}
+	repo.URL = strings.ReplaceAll(u, "${ABI}", p.abi)
+	if repo.URL != "" {
+		p.repos = append(p.repos, repo)
+	}
+}
+
+// streamRepos runs pkg -vv and parses repositories line by line without
+// holding the whole output in memory. Lines of any length are accepted.
+func streamRepos(ctx context.Context, abi string) ([]Repo, error) {
+	if remote != nil {
+		out, err := runCmdCapture(ctx, "pkg", []string{"-vv"})
+		if err != nil {
+			return nil, err
+		}
+		p := repoParser{abi: abi}
+		for _, line := range strings.SplitAfter(out, "\n") {
+			p.feed(line)
+		}
+		return p.repos, nil
+	}
+	name, args := targetCommand("pkg", []string{"-vv"})
+	cmd := exec.CommandContext(ctx, name, args...)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	p := repoParser{abi: abi}
+	r := bufio.NewReader(stdout)
+	for {
+		line, err := r.ReadString('\n')
+		if line != "" {
+			p.feed(line)
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			_ = cmd.Wait()
+			return nil, err
+		}
+	}
+	if err := cmd.Wait(); err != nil {
+		return nil, err
+	}
+	return p.repos, nil
+}
+
+// catalogFiles are the per-ABI catalog archives pkg fetches, newest
+// naming first.
+var catalogFiles = []string{"packagesite.pkg", "packagesite.txz"}
+
+// estimateCatalogSize HEADs each repo's catalog archive and sums the
+// Content-Length values. The archive bodies are never downloaded.
+func estimateCatalogSize(ctx context.Context, cfg Config) (string, string, map[string]any) {
+	repos, err := configuredRepos(ctx, cfg)
+	if err != nil {
+		return "Could not determine repositories", err.Error(), nil
+	}
+	client := &http.Client{Timeout: 6 * time.Second}
+	sizes := map[string]any{}
+	var total int64
+	var lines []string
+	for _, r := range repos {
+		if r.Disabled || cfg.RepoRegex != nil && !cfg.RepoRegex.MatchString(r.Name) {
+			continue
+		}
+		size, file, err := catalogSize(ctx, client, r.URL)
+		if err != nil {
+			lines = append(lines, fmt.Sprintf("%s: unknown (%v)", r.Name, err))
+			continue
+		}
+		total += size
+		sizes[r.Name] = size
+		lines = append(lines, fmt.Sprintf("%s: %s (%s)", r.Name, humanBytes(size), file))
+	}
+	msg := fmt.Sprintf("This update will fetch ~%s of catalog", humanBytes(total))
+	return msg, strings.Join(lines, "\n"), map[string]any{"total_bytes": total, "repos": sizes}
+}
+
+func catalogSize(ctx context.Context, client *http.Client, repoURL string) (int64, string, error) {
+	base := strings.TrimRight(repoURL, "/")
+	var lastErr error
+	for _, name := range catalogFiles {
+		req, err := http.NewRequestWithContext(ctx, http.MethodHead, base+"/"+name, nil)
+		if err != nil {
+			return 0, "", err
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			lastErr = fmt.Errorf("HEAD %s status %d", name, resp.StatusCode)
+			continue
+		}
+		if resp.ContentLength < 0 {
+			return 0, "", fmt.Errorf("%s has no Content-Length", name)
+		}
+		return resp.ContentLength, name, nil
+	}
+	return 0, "", lastErr
+}
+
+func humanBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for v := n / unit; v >= unit; v /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// maxRetryAfter caps how long probeRepo will honor a Retry-After header
+// before giving up on the single delayed retry.
+const maxRetryAfter = 10 * time.Second
+
+// probeRepo reports StatusOK for a healthy mirror, StatusWarn for a mirror
+// that is up but shedding load (429/503), StatusSkip for schemes it cannot
+// probe, and StatusError otherwise.
+func probeRepo(ctx context.Context, raw string) (Status, string) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return StatusError, fmt.Sprintf("%s (parse error: %v)", raw, err)
+	}
+	// Callers holding a URL straight from a repo config may still have
+	// pkg's own scheme prefix on it.
+	u.Scheme = strings.TrimPrefix(u.Scheme, "pkg+")
+	switch u.Scheme {
+	case "http", "https":
+	case "file":
+		fi, err := os.Stat(u.Path)
+		if err != nil {
+			return StatusError, fmt.Sprintf("%s (%v)", raw, err)
+		}
+		if !fi.IsDir() {
+			return StatusError, fmt.Sprintf("%s (not a directory)", raw)
+		}
+		data, err := os.ReadFile(filepath.Join(u.Path, "meta.conf"))
+		if err != nil {
+			return StatusError, fmt.Sprintf("%s (directory exists but has no meta.conf)", raw)
+		}
+		if !reMetaKey.Match(data) {
+			return StatusWarn, fmt.Sprintf("%s (meta.conf content unexpected)", raw)
+		}
+		return StatusOK, fmt.Sprintf("%s (ok, local)", raw)
+	case "ftp":
+		return StatusSkip, fmt.Sprintf("%s (ftp scheme not probed)", raw)
+	default:
+		return StatusError, fmt.Sprintf("%s (unsupported scheme %q)", raw, u.Scheme)
+	}
+	// Hostname strips the brackets from IPv6 literals and any port.
+	host, port := u.Hostname(), u.Port()
+	if port == "" {
+		port = "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+	}
+	meta := strings.TrimRight(u.String(), "/") + "/meta.conf"
+	client := &http.Client{
+		Timeout:   6 * time.Second,
+		Transport: &http.Transport{Proxy: http.ProxyFromEnvironment},
+	}
+
+	// Behind a proxy the mirror is often not directly reachable, so the
+	// raw TCP check would fail for the wrong reason; let the proxy decide.
+	via := ""
+	if req, err := http.NewRequest(http.MethodHead, meta, nil); err == nil {
+		if proxy, err := http.ProxyFromEnvironment(req); err == nil && proxy != nil {
+			via = "via proxy " + proxy.Host
+		}
+	}
+	if via == "" {
+		// Resolve separately so a broken resolver is not mistaken for a
+		// mirror refusing connections.
+		addrs, err := resolveHost(ctx, host)
+		if err != nil {
+			return StatusError, fmt.Sprintf("%s (DNS resolution failed: %v)", raw, err)
+		}
+		start := time.Now()
+		family, err := dialEitherFamily(ctx, addrs, port)
+		connect := time.Since(start)
+		if err != nil {
+			return StatusError, fmt.Sprintf("%s (tcp connect failed: %v)", raw, err)
+		}
+		via = family + " " + strings.Join(addrs, ", ") + ", connect " + ms(connect)
+	}
+
+	for attempt := 0; ; attempt++ {
+		start := time.Now()
+		resp, body, err := fetchMeta(ctx, client, meta)
+		fetch := time.Since(start)
+		if resp == nil {
+			return StatusError, fmt.Sprintf("%s (GET /meta.conf failed: %v)", raw, err)
+		}
+		if resp.StatusCode >= 200 && resp.StatusCode < 400 {
+			if resp.ProtoMajor >= 2 && !reachableHTTP1(ctx, meta) {
+				// pkg's libfetch only speaks HTTP/1.1.
+				return StatusWarn, fmt.Sprintf("%s (reachable only via %s; pkg uses HTTP/1.1)", raw, resp.Proto)
+			}
+			if err != nil {
+				return StatusWarn, fmt.Sprintf("%s (meta.conf could not be read: %v)", raw, err)
+			}
+			// Captive portals and error pages answer 200 too; only a body
+			// with pkg's own keys proves this is a repository.
+			if !reMetaKey.Match(body) {
+				ctype := resp.Header.Get("Content-Type")
+				if ctype == "" {
+					ctype = "no Content-Type"
+				}
+				return StatusWarn, fmt.Sprintf("%s (meta.conf content unexpected, %s)", raw, ctype)
+			}
+			return StatusOK, fmt.Sprintf("%s (ok, %s, %s, meta %s)", raw, resp.Proto, via, ms(fetch))
+		}
+		if resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode != http.StatusServiceUnavailable {
+			return StatusError, fmt.Sprintf("%s (GET /meta.conf status %d, %s, meta %s)", raw, resp.StatusCode, via, ms(fetch))
+		}
+
+		// Busy mirror: honor Retry-After once if it fits in the stage budget.
+		wait, ok := parseRetryAfter(resp.Header.Get("Retry-After"))
+		if !ok {
+			return StatusWarn, fmt.Sprintf("%s (mirror temporarily unavailable, status %d)", raw, resp.StatusCode)
+		}
+		if attempt == 0 && wait <= maxRetryAfter && fitsDeadline(ctx, wait) {
+			select {
+			case <-time.After(wait):
+				continue
+			case <-ctx.Done():
+			}
+		}
+		return StatusWarn, fmt.Sprintf("%s (mirror temporarily unavailable, retry after %d s)", raw, int(wait.Seconds()))
+	}
+}
+
+// maxMetaBytes bounds how much of meta.conf is read; the keys that
+// identify it are at the top, and the whole file is well under this.
+const maxMetaBytes = 4 << 10
+
+// reMetaKey matches a key only a pkg repository meta.conf would have.
+var reMetaKey = regexp.MustCompile(`(?m)^\s*"?(version|packing_format|manifests|digests)"?\s*[:=]`)
+
+// fetchMeta GETs a meta.conf and reads the start of it, so one request
+// both checks the mirror and shows what it serves. The response is nil
+// when no request could be made; otherwise err is about reading the body,
+// which is closed.
+func fetchMeta(ctx context.Context, client *http.Client, target string) (*http.Response, []byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxMetaBytes))
+	return resp, body, err
+}
+
+// ms renders a probe duration the way the network report shows them.
+func ms(d time.Duration) string {
+	return fmt.Sprintf("%dms", d.Milliseconds())
+}
+
+// resolveHost returns the addresses of host; an IP literal resolves to
+// itself.
+func resolveHost(ctx context.Context, host string) ([]string, error) {
+	if net.ParseIP(host) != nil {
+		return []string{host}, nil
+	}
+	return net.DefaultResolver.LookupHost(ctx, host)
+}
+
+// dialEitherFamily opens (and closes) a TCP connection to one of addrs,
+// trying IPv6 and IPv4 addresses in turn so a dual-stack host counts as
+// reachable if either family works. It returns the family that succeeded.
+func dialEitherFamily(ctx context.Context, addrs []string, port string) (string, error) {
+	d := net.Dialer{Timeout: 5 * time.Second}
+	var errs []string
+	for _, family := range []string{"IPv6", "IPv4"} {
+		var lastErr error
+		for _, addr := range addrs {
+			ip := net.ParseIP(addr)
+			if ip == nil || (ip.To4() == nil) != (family == "IPv6") {
+				continue
+			}
+			conn, err := d.DialContext(ctx, "tcp", net.JoinHostPort(addr, port))
+			if err == nil {
+				_ = conn.Close()
+				return family, nil
+			}
+			lastErr = err
+		}
+		if lastErr != nil {
+			errs = append(errs, family+": "+lastErr.Error())
+		}
+	}
+	if len(errs) == 0 {
+		return "", errors.New("no usable addresses")
+	}
+	return "", errors.New(strings.Join(errs, "; "))
+}
+
+// probeRepoViaPkg checks reachability through the same libfetch code path
+// pkg uses, so the verdict matches real pkg behaviour (TLS stack, proxy
+// handling, address family preference). It needs fetch(1): a scoped pkg
+// update would exercise the same path but rewrite the catalog, and compete
+// for the database lock with the other probes, from a read-only check.
+// fetch(1) is looked up on the target, which under --remote is not the
+// machine running ppr.
+func probeRepoViaPkg(ctx context.Context, r Repo) (Status, string) {
+	meta := strings.TrimRight(r.URL, "/") + "/meta.conf"
+	if _, err := runCmdCapture(ctx, "sh", []string{"-c", "command -v fetch"}); err != nil {
+		return StatusSkip, fmt.Sprintf("%s (fetch(1) not available; not probed)", r.URL)
+	}
+	out, err := runCmdCapture(ctx, "fetch", []string{"-q", "-T", "15", "-o", "/dev/null", meta})
+	if err != nil {
+		return StatusError, fmt.Sprintf("%s (fetch failed: %s)", r.URL, strings.TrimSpace(tail(out+err.Error(), 200)))
+	}
+	return StatusOK, fmt.Sprintf("%s (ok via fetch)", r.URL)
+}
+
+// reachableHTTP1 repeats a request with HTTP/2 disabled, mirroring what
+// pkg's fetch backend will negotiate.
+func reachableHTTP1(ctx context.Context, target string) bool {
+	client := &http.Client{
+		Timeout: 6 * time.Second,
+		Transport: &http.Transport{
+			Proxy:        http.ProxyFromEnvironment,
+			TLSNextProto: map[string]func(string, *tls.Conn) http.RoundTripper{},
+		},
+	}
+	resp, _, err := headOrGet(ctx, client, target)
+	if err != nil {
+		return false
+	}
+	return resp.StatusCode >= 200 && resp.StatusCode < 400
+}
+
+// headOrGet checks target with a HEAD request, so a liveness probe does
+// not download the file, falling back to GET for servers that answer 405.
+// The body is closed; the method actually used is returned for messages.
+func headOrGet(ctx context.Context, client *http.Client, target string) (*http.Response, string, error) {
+	var resp *http.Response
+	for _, method := range []string{http.MethodHead, http.MethodGet} {
+		req, err := http.NewRequestWithContext(ctx, method, target, nil)
+		if err != nil {
+			return nil, method, err
+		}
+		resp, err = client.Do(req)
+		if err != nil {
+			return nil, method, err
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusMethodNotAllowed {
+			return resp, method, nil
+		}
+	}
+	return resp, http.MethodGet, nil
+}
+
+// parseRetryAfter accepts both forms of the header: delay-seconds and an
+// HTTP date.
+func parseRetryAfter(v string) (time.Duration, bool) {
+	v = strings.TrimSpace(v)
+	if v == "" {
+		return 0, false
+	}
+	if secs, err := strconv.Atoi(v); err == nil && secs >= 0 {
+		return time.Duration(secs) * time.Second, true
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		d := time.Until(t)
+		if d < 0 {
+			d = 0
+		}
+		return d.Round(time.Second), true
+	}
+	return 0, false
+}
+
+func fitsDeadline(ctx context.Context, d time.Duration) bool {
+	deadline, ok := ctx.Deadline()
+	return !ok || time.Until(deadline) > d
+}
+
+// --- Helpers ---
+
+func runCmdCapture(ctx context.Context, name string, args []string) (string, error) {
+	stdout, stderr, err := runCmdCaptureSplit(ctx, name, args)
+	return stdout + stderr, err
+}
+
+// exitStatus returns the exit code behind err: 0 for success, the
+// command's status for a local or remote exit error, and -1 when the
+// command could not be run or was killed.
+func exitStatus(err error) int {
+	if err == nil {
+		return 0
+	}
+	var exitErr *exec.ExitError
+	var sshErr *ssh.ExitError
+	switch {
+	case errors.As(err, &exitErr):
+		return exitErr.ExitCode()
+	case errors.As(err, &sshErr):
+		return sshErr.ExitStatus()
+	}
+	return -1
+}
+
+// targetCommand points a command at the system being repaired: pkg gets
+// -j for --jail or -c for --rootdir, and under --jail every other command
+// runs in the jail through jexec(8).
+func targetCommand(name string, args []string) (string, []string) {
+	switch {
+	case name == "pkg" && jailName != "":
+		return name, append([]string{"-j", jailName}, args...)
+	case name == "pkg" && rootDir != "":
+		return name, append([]string{"-c", rootDir}, args...)
+	case jailName != "":
+		return "jexec", append([]string{jailName, name}, args...)
+	}
+	return name, args
+}
+
+// runCmdCaptureSplit is runCmdCapture with stdout and stderr kept apart, for
+// callers that need to inspect what a command printed as diagnostics.
+func runCmdCaptureSplit(ctx context.Context, name string, args []string) (string, string, error) {
+	name, args = targetCommand(name, args)
+	if remote != nil {
+		return remote.run(ctx, name, args)
+	}
+	cmd := exec.CommandContext(ctx, name, args...)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return "", "", err
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return "", "", err
+	}
+	if err := cmd.Start(); err != nil {
+		return "", "", err
+	}
+	var errOut string
+	var errScan error
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		errOut, errScan = scanLines(stderr)
+	}()
+	out, scanErr := scanLines(stdout)
+	<-done
+	if scanErr == nil {
+		scanErr = errScan
+	}
+	if scanErr != nil {
+		_ = cmd.Wait()
+		return out, errOut, scanErr
+	}
+	if err := cmd.Wait(); err != nil {
+		return out, errOut, err
+	}
+	return out, errOut, nil
+}
+
+// scanLines reads r to the end, normalizing line endings to \n. It uses a
+// bufio.Reader rather than a Scanner so lines of any length (pkg check -da
+// can print very long dependency lines) are kept whole.
+func scanLines(r io.Reader) (string, error) {
+	br := bufio.NewReader(r)
+	var b strings.Builder
+	for {
+		line, err := br.ReadString('\n')
+		if line != "" {
+			b.WriteString(strings.TrimRight(line, "\r\n"))
+			b.WriteByte('\n')
+		}
+		if err == io.EOF {
+			return b.String(), nil
+		}
+		if err != nil {
+			return b.String(), err
+		}
+	}
+}
+
+// rootDir is the --rootdir of a jail or mounted system being repaired. pkg
+// runs chrooted into it (pkg -c) and the paths ppr inspects are moved
+// inside it by useRootDir.
+var rootDir string
+
+// useRootDir sets rootDir and moves the paths ppr inspects inside it.
+func useRootDir(dir string) {
+	rootDir = dir
+	pkgDBDir = filepath.Join(rootDir, pkgDBDir)
+	pkgKeysDir = filepath.Join(rootDir, pkgKeysDir)
+	osReleasePath = filepath.Join(rootDir, osReleasePath)
+	// freebsd-version(1) is a script that prints the userland version it
+	// was installed with, so the root's own copy reports the root.
+	freebsdVersion = filepath.Join(rootDir, "/bin/freebsd-version")
+	for i, p := range ghostbsdRepoConfs {
+		ghostbsdRepoConfs[i] = filepath.Join(rootDir, p)
+	}
+}
+
+// jailName is the --jail to repair: pkg runs with -j and other commands
+// through jexec, so no host paths are touched.
+var jailName string
+
+var pkgDBDir = "/var/db/pkg"
+
+// defaultCacheGlobs are the catalog files StageClearCache removes.
+var defaultCacheGlobs = []string{"repo-*.sqlite*"}
+
+// catalogAllowlist is the hard limit on what StageClearCache may delete,
+// whatever patterns it is configured with. Only repo catalogs and their
+// sidecar files directly inside the db dir qualify; local.sqlite never does.
+var catalogAllowlist = []string{
+	"repo-*.sqlite",
+	"repo-*.sqlite-*",
+	"repo-*.sqlite.*",
+	"repo-*.meta",
+}
+
+func cacheGlobs(cfg Config) []string {
+	if len(cfg.CacheGlobs) > 0 {
+		return cfg.CacheGlobs
+	}
+	return defaultCacheGlobs
+}
+
+func globRepoSqlite(ctx context.Context, patterns []string) ([]string, error) {
+	if len(patterns) == 0 {
+		patterns = defaultCacheGlobs
+	}
+	seen := map[string]bool{}
+	var out []string
+	for _, pat := range patterns {
+		matches, err := globFiles(ctx, filepath.Join(pkgDBDir, pat))
+		if err != nil {
+			return nil, err
+		}
+		for _, m := range matches {
+			if !seen[m] {
+				seen[m] = true
+				out = append(out, m)
+			}
+		}
+	}
+	return out, nil
+}
+
+// disallowedPaths returns every path that is not a regular catalog file
+// directly under base matching catalogAllowlist.
+func disallowedPaths(ctx context.Context, base string, paths []string) []string {
+	var refused []string
+	for _, p := range paths {
+		if filepath.Dir(filepath.Clean(p)) != base || !allowlisted(filepath.Base(p)) {
+			refused = append(refused, p)
+			continue
+		}
+		if !isRegularFile(ctx, p) {
+			refused = append(refused, p)
+		}
+	}
+	return refused
+}
+
+func allowlisted(name string) bool {
+	for _, pat := range catalogAllowlist {
+		if ok, _ := filepath.Match(pat, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// --- Remote execution ---
+
+// remote, when set by --remote, runs every command and file operation on
+// another host over SSH. main sets it once before the first stage.
+var remote *remoteHost
+
+// remoteHost is an SSH connection to the machine being repaired.
+type remoteHost struct {
+	client *ssh.Client
+}
+
+// remoteCapable reports whether a stage can run against a remote host or
+// jail. The rest inspect this machine with Go APIs rather than commands.
+func remoteCapable(s Stage) bool {
+	switch s {
+	case StageDNSCheck, StageKeysPerms, StageCatalogSize, StageSetBranch:
+		return false
+	}
+	return true
+}
+
+// dialRemote connects to user@host[:port], authenticating through
+// ssh-agent and checking the host key against ~/.ssh/known_hosts.
+func dialRemote(target string) (*remoteHost, error) {
+	user, host, ok := strings.Cut(target, "@")
+	if !ok {
+		user, host = os.Getenv("USER"), target
+	}
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		host = net.JoinHostPort(host, "22")
+	}
+	sock := os.Getenv("SSH_AUTH_SOCK")
+	if sock == "" {
+		return nil, errors.New("--remote needs a running ssh-agent (SSH_AUTH_SOCK is not set)")
+	}
+	conn, err := net.Dial("unix", sock)
+	if err != nil {
+		return nil, fmt.Errorf("ssh-agent: %w", err)
+	}
+	defer conn.Close()
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return nil, err
+	}
+	hostKeys, err := knownhosts.New(filepath.Join(home, ".ssh", "known_hosts"))
+	if err != nil {
+		return nil, fmt.Errorf("known_hosts: %w", err)
+	}
+	client, err := ssh.Dial("tcp", host, &ssh.ClientConfig{
+		User:            user,
+		Auth:            []ssh.AuthMethod{ssh.PublicKeysCallback(agent.NewClient(conn).Signers)},
+		HostKeyCallback: hostKeys,
+		Timeout:         15 * time.Second,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &remoteHost{client: client}, nil
+}
+
+// run executes name with args on the remote host in a fresh session,
+// killing it if ctx ends first.
+func (r *remoteHost) run(ctx context.Context, name string, args []string) (string, string, error) {
+	sess, err := r.client.NewSession()
+	if err != nil {
+		return "", "", err
+	}
+	defer sess.Close()
+	stdout, err := sess.StdoutPipe()
+	if err != nil {
+		return "", "", err
+	}
+	stderr, err := sess.StderrPipe()
+	if err != nil {
+		return "", "", err
+	}
+	if err := sess.Start(shellQuote(append([]string{name}, args...))); err != nil {
+		return "", "", err
+	}
+	stop := context.AfterFunc(ctx, func() {
+		_ = sess.Signal(ssh.SIGKILL)
+		_ = sess.Close()
+	})
+	defer stop()
+
+	var errOut string
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		errOut, _ = scanLines(stderr)
+	}()
+	out, _ := scanLines(stdout)
+	<-done
+	err = sess.Wait()
+	if err != nil && ctx.Err() != nil {
+		err = ctx.Err()
+	}
+	return out, errOut, err
+}
+
+// shellQuote joins words into a command line for the remote shell,
+// single-quoting each one.
+func shellQuote(words []string) string {
+	quoted := make([]string, len(words))
+	for i, w := range words {
+		quoted[i] = "'" + strings.ReplaceAll(w, "'", `'\''`) + "'"
+	}
+	return strings.Join(quoted, " ")
+}
+
+// The helpers below are the file operations stages need, done locally or,
+// under --remote or --jail, with the equivalent command on the target.
+
+// hostLocal reports whether paths can be used directly by this process,
+// rather than through commands run on a remote host or inside a jail.
+func hostLocal() bool {
+	return remote == nil && jailName == ""
+}
+
+func effectiveUID(ctx context.Context) int {
+	if hostLocal() {
+		return os.Geteuid()
+	}
+	out, err := runCmdCapture(ctx, "id", []string{"-u"})
+	if err != nil {
+		return -1
+	}
+	uid, err := strconv.Atoi(strings.TrimSpace(out))
+	if err != nil {
+		return -1
+	}
+	return uid
+}
+
+func fileExists(ctx context.Context, path string) bool {
+	if hostLocal() {
+		_, err := os.Stat(path)
+		return err == nil
+	}
+	_, err := runCmdCapture(ctx, "test", []string{"-e", path})
+	return err == nil
+}
+
+// minFreeBytes is the least free space ppr wants next to the package
+// database however small it is, since pkg update writes fresh catalogs.
+const minFreeBytes = 64 << 20
+
+// dbSpace reports the space available on the filesystem holding pkgDBDir
+// and the combined size of the databases in it. Rebuilding writes a new
+// copy of each, so a full /var fails in ways that look like corruption.
+func dbSpace(ctx context.Context) (free, used int64, err error) {
+	if hostLocal() {
+		var st syscall.Statfs_t
+		if err := syscall.Statfs(pkgDBDir, &st); err != nil {
+			return 0, 0, err
+		}
+		free = int64(st.Bavail) * int64(st.Bsize)
+		paths, err := filepath.Glob(filepath.Join(pkgDBDir, "*.sqlite*"))
+		if err != nil {
+			return 0, 0, err
+		}
+		for _, p := range paths {
+			if fi, err := os.Stat(p); err == nil {
+				used += fi.Size()
+			}
+		}
+		return free, used, nil
+	}
+	if !reSafeGlob.MatchString(pkgDBDir) {
+		return 0, 0, fmt.Errorf("%s cannot be measured remotely", pkgDBDir)
+	}
+	out, err := runCmdCapture(ctx, "df", []string{"-k", pkgDBDir})
+	if err != nil {
+		return 0, 0, err
+	}
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	fields := strings.Fields(lines[len(lines)-1])
+	if len(fields) < 4 {
+		return 0, 0, fmt.Errorf("unexpected df output %q", out)
+	}
+	kb, err := strconv.ParseInt(fields[3], 10, 64)
+	if err != nil {
+		return 0, 0, err
+	}
+	free = kb << 10
+	out, err = runCmdCapture(ctx, "/bin/sh", []string{"-c", "du -ck " + pkgDBDir + "/*.sqlite* | tail -1"})
+	if err != nil {
+		return 0, 0, err
+	}
+	fields = strings.Fields(out)
+	if len(fields) == 0 {
+		return free, 0, nil
+	}
+	kb, err = strconv.ParseInt(fields[0], 10, 64)
+	if err != nil {
+		return 0, 0, err
+	}
+	return free, kb << 10, nil
+}
+
+// isRegularFile reports whether path is a regular file, not a symlink.
+func isRegularFile(ctx context.Context, path string) bool {
+	if hostLocal() {
+		fi, err := os.Lstat(path)
+		return err == nil && fi.Mode().IsRegular()
+	}
+	_, err := runCmdCapture(ctx, "test", []string{"-f", path, "-a", "!", "-h", path})
+	return err == nil
+}
+
+func readFile(ctx context.Context, path string) ([]byte, error) {
+	if hostLocal() {
+		return os.ReadFile(path)
+	}
+	out, err := runCmdCapture(ctx, "cat", []string{path})
+	return []byte(out), err
+}
+
+func renameFile(ctx context.Context, from, to string) error {
+	if hostLocal() {
+		return os.Rename(from, to)
+	}
+	if out, err := runCmdCapture(ctx, "mv", []string{from, to}); err != nil {
+		return fmt.Errorf("%s: %w", strings.TrimSpace(out), err)
+	}
+	return nil
+}
+
+// removeFiles deletes paths, ignoring failures like os.Remove callers did.
+func removeFiles(ctx context.Context, paths []string) {
+	if hostLocal() {
+		for _, p := range paths {
+			_ = os.Remove(p)
+		}
+		return
+	}
+	_, _ = runCmdCapture(ctx, "rm", append([]string{"-f", "--"}, paths...))
+}
+
+// reSafeGlob limits the patterns expanded by the remote shell to plain
+// file globs, since they cannot be quoted.
+var reSafeGlob = regexp.MustCompile(`^[A-Za-z0-9._/*?\[\]-]+$`)
+
+func globFiles(ctx context.Context, pattern string) ([]string, error) {
+	if hostLocal() {
+		return filepath.Glob(pattern)
+	}
+	if !reSafeGlob.MatchString(pattern) {
+		return nil, fmt.Errorf("pattern %q cannot be expanded remotely", pattern)
+	}
+	script := `for f in ` + pattern + `; do [ -e "$f" ] && printf '%s\n' "$f"; done; true`
+	out, err := runCmdCapture(ctx, "/bin/sh", []string{"-c", script})
+	if err != nil {
+		return nil, err
+	}
+	// One path per line: the matches may contain spaces even though the
+	// pattern cannot.
+	var paths []string
+	for _, p := range strings.Split(out, "\n") {
+		if p != "" {
+			paths = append(paths, p)
+		}
+	}
+	return paths, nil
+}
+
+// stageCommands returns the shell commands equivalent to what a stage did
+// (or would do), so the repair can be repeated or customised by hand.
+func stageCommands(ev Event) []string {
+	if would, ok := ev.Data["would_run"].([]string); ok {
+		return would
+	}
+	switch ev.Stage {
+	case StageClearCache:
+		return []string{"rm -f " + pkgDBDir + "/repo-*.sqlite*"}
+	case StagePkgUpdate:
+		if ev.Status == StatusWarn {
+			return []string{"pkg bootstrap -f", "pkg update -f"}
+		}
+		return []string{"pkg update -f"}
+	case StagePkgCheckDA, StagePkgRecheckDA:
+		return []string{"pkg check -da"}
+	case StagePkgRecompute:
+		return []string{"pkg check -r -a"}
+	case StagePkgUpgrade:
+		return []string{"pkg upgrade -y"}
+	case StagePkgClean:
+		return []string{"pkg clean -a -y"}
+	case StageMoveLocalDB:
+		backup, _ := ev.Data["backup"].(string)
+		if ev.Message != "Moved local.sqlite aside" || backup == "" {
+			return nil
+		}
+		return []string{
+			"mv " + filepath.Join(pkgDBDir, "local.sqlite") + " " + backup,
+			"pkg update -f",
+			"pkg check -da",
+		}
+	case StageSmokeTest:
+		if pkg, ok := ev.Data["package"].(string); ok {
+			return []string{"pkg rquery '%n-%v (%R)' " + pkg}
+		}
+	}
+	return nil
+}
+
+func writeSuggestedCommands(w io.Writer, events []Event) {
+	fmt.Fprintln(w, "# Commands to perform this repair manually (as root):")
+	for _, ev := range events {
+		cmds := stageCommands(ev)
+		if len(cmds) == 0 {
+			continue
+		}
+		fmt.Fprintf(w, "# %s (%s)\n", humanStage(ev.Stage), ev.Status)
+		for _, c := range cmds {
+			fmt.Fprintln(w, c)
+		}
+	}
+}
+
+const lockPath = "/var/run/ppr.lock"
+
+// acquireLock takes an advisory flock on lockPath so two ppr runs never
+// operate on the pkg database at the same time. The lock is released when
+// the returned file is closed or the process exits.
+func acquireLock(path string, wait bool) (*os.File, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	how := syscall.LOCK_EX
+	if !wait {
+		how |= syscall.LOCK_NB
+	}
+	if err := syscall.Flock(int(f.Fd()), how); err != nil {
+		holder, _ := os.ReadFile(path)
+		f.Close()
+		if err == syscall.EWOULDBLOCK {
+			pid := strings.TrimSpace(string(holder))
+			if pid == "" {
+				pid = "unknown"
+			}
+			return nil, fmt.Errorf("another ppr instance (pid %s) holds %s", pid, path)
+		}
+		return nil, err
+	}
+	_ = f.Truncate(0)
+	_, _ = f.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0)
+	return f, nil
+}
+
+// --- Event sinks ---
+
+// Summary is what sinks learn about a run once it has finished.
+type Summary struct {
+	Status  Status
+	Attempt int
+	Err     error
+	// Events are the run's final events, with a stage re-run with r
+	// appearing once with its last result.
+	Events []Event
+}
+
+// EventSink is an output for events. Emit is called as each event is
+// recorded, Close once when the run ends.
+type EventSink interface {
+	Emit(Event)
+	Close(Summary) error
+}
+
+// newSinks builds the sinks selected by cfg.
+func newSinks(cfg Config) []EventSink {
+	var sinks []EventSink
+	if cfg.Syslog != nil {
+		sinks = append(sinks, syslogSink{w: cfg.Syslog})
+	}
+	if cfg.NDJSON != nil {
+		sinks = append(sinks, &ndjsonSink{enc: json.NewEncoder(cfg.NDJSON)})
+	}
+	if cfg.JSONReport != "" {
+		sinks = append(sinks, &jsonReportSink{cfg: cfg})
+	}
+	return sinks
+}
+
+// ndjsonSink appends each event to a file as one JSON line the moment it
+// is recorded, so the log survives a crash or kill mid-run.
+type ndjsonSink struct {
+	enc *json.Encoder
+	err error
+}
+
+func (s *ndjsonSink) Emit(ev Event) {
+	if err := s.enc.Encode(ev); err != nil && s.err == nil {
+		s.err = err
+	}
+}
+
+func (s *ndjsonSink) Close(Summary) error { return s.err }
+
+// jsonReportSink writes the run's events as one JSON array when the run
+// ends, since anonymizing needs to see every event. It takes them from the
+// summary rather than collecting what is emitted, so a re-run stage
+// replaces its earlier result instead of appearing twice.
+type jsonReportSink struct {
+	cfg Config
+}
+
+func (s *jsonReportSink) Emit(Event) {}
+
+func (s *jsonReportSink) Close(sum Summary) error { return writeReport(s.cfg, sum.Events) }
+
+// syslogSink logs each event as it happens. The writer is shared across
+// runs and closed by main.
+type syslogSink struct {
+	w *syslog.Writer
+}
+
+func (s syslogSink) Emit(ev Event) { logEvent(s.w, ev) }
+
+func (s syslogSink) Close(Summary) error { return nil }
+
+// checkReportPath fails fast when the report could not be written, so a
+// typo in --report-json is caught before the run rather than after it.
+func checkReportPath(path string) error {
+	if path == "" || path == "-" {
+		return nil
+	}
+	if fi, err := os.Stat(path); err == nil && fi.IsDir() {
+		return fmt.Errorf("report path %s is a directory", path)
+	}
+	dir := filepath.Dir(path)
+	fi, err := os.Stat(dir)
+	if err != nil {
+		return fmt.Errorf("report directory: %w", err)
+	}
+	if !fi.IsDir() {
+		return fmt.Errorf("report directory %s is not a directory", dir)
+	}
+	f, err := os.CreateTemp(dir, ".ppr-report-*")
+	if err != nil {
+		return fmt.Errorf("report directory %s is not writable: %w", dir, err)
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+// writeReport writes the JSON report and, if requested, its checksum.
+func writeReport(cfg Config, events []Event) error {
+	if cfg.Anonymize {
+		events = newAnonymizer(cfg, events).events(events)
+	}
+	if err := writeJSONReport(cfg.JSONReport, events); err != nil {
+		return err
+	}
+	if cfg.Checksum && cfg.JSONReport != "" {
+		return writeChecksum(cfg.JSONReport)
+	}
+	return nil
+}
+
+var (
+	reURLHost = regexp.MustCompile(`[a-zA-Z][a-zA-Z0-9+.-]*://([^/\s"'()\[\]:]+)`)
+	reIPv4    = regexp.MustCompile(`\b(?:\d{1,3}\.){3}\d{1,3}\b`)
+	reIPv6    = regexp.MustCompile(`[0-9a-fA-F]{0,4}(?::[0-9a-fA-F]{0,4}){2,7}`)
+)
+
+// anonymizer replaces hostnames and IP addresses with stable pseudonyms
+// (host-a, 10.x.x.1, ...) so a report can be shared publicly while keeping
+// its structure. The mapping lives only in memory, for one report.
+type anonymizer struct {
+	hosts   map[string]string
+	order   []string // known hosts, longest first
+	ips     map[string]string
+	nextIP4 int
+	nextIP6 int
+	// jail matches the --jail name as a whole word, since a short name
+	// like "web" must not be replaced inside other words.
+	jail *regexp.Regexp
+}
+
+// newAnonymizer learns the hostnames to scrub from URLs in the events, from
+// the DNS stage's host list and from the --remote target, which appears in
+// the target description and SSH errors; it also scrubs the --jail name.
+func newAnonymizer(cfg Config, events []Event) *anonymizer {
+	a := &anonymizer{hosts: map[string]string{}, ips: map[string]string{}}
+	if jailName != "" {
+		a.jail = regexp.MustCompile(`\b` + regexp.QuoteMeta(jailName) + `\b`)
+	}
+	learn := func(h string) {
+		if h == "" || net.ParseIP(h) != nil {
+			return
+		}
+		if _, ok := a.hosts[h]; !ok {
+			a.hosts[h] = pseudonym(len(a.hosts))
+			a.order = append(a.order, h)
+		}
+	}
+	if cfg.Remote != "" {
+		host := cfg.Remote
+		if _, h, ok := strings.Cut(host, "@"); ok {
+			host = h
+		}
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		learn(host)
+	}
+	for _, ev := range events {
+		for _, m := range reURLHost.FindAllStringSubmatch(ev.Message+"\n"+ev.Detail, -1) {
+			learn(m[1])
+		}
+		if hosts, ok := ev.Data["hosts"].([]string); ok {
+			for _, h := range hosts {
+				learn(h)
+			}
+		}
 	}
+	sort.SliceStable(a.order, func(i, j int) bool { return len(a.order[i]) > len(a.order[j]) })
+	return a
+}
 
-	if okAll {
-		return "DNS resolution working", strings.Join(lines, "\n"), true
+// pseudonym maps 0, 1, ... to host-a, host-b, ..., host-z, host-27, ...
+func pseudonym(i int) string {
+	if i < 26 {
+		return "host-" + string(rune('a'+i))
 	}
-	return "Some DNS lookups failed", strings.Join(lines, "\n"), false
+	return "host-" + strconv.Itoa(i+1)
 }
 
-// --- Repository Network Check ---
-
-func checkRepoNetwork(ctx context.Context) (string, string, bool) {
-	abi, _ := runCmdCapture(ctx, "pkg", []string{"config", "ABI"})
-	cfg, err := runCmdCapture(ctx, "pkg", []string{"-vv"})
-	if err != nil {
-		return "Could not run pkg -vv", err.Error(), false
+func (a *anonymizer) text(s string) string {
+	for _, h := range a.order {
+		s = strings.ReplaceAll(s, h, a.hosts[h])
 	}
-	urls := parseRepoURLs(cfg, strings.TrimSpace(abi))
-	if len(urls) == 0 {
-		return "Could not detect repository URLs", "No url entries parsed from pkg -vv output", false
+	if a.jail != nil {
+		s = a.jail.ReplaceAllLiteralString(s, "jail-a")
 	}
+	s = reIPv4.ReplaceAllStringFunc(s, func(ip string) string {
+		if net.ParseIP(ip) == nil {
+			return ip
+		}
+		if _, ok := a.ips[ip]; !ok {
+			a.nextIP4++
+			a.ips[ip] = fmt.Sprintf("10.x.x.%d", a.nextIP4)
+		}
+		return a.ips[ip]
+	})
+	return reIPv6.ReplaceAllStringFunc(s, func(ip string) string {
+		if net.ParseIP(ip) == nil {
+			return ip
+		}
+		if _, ok := a.ips[ip]; !ok {
+			a.nextIP6++
+			a.ips[ip] = fmt.Sprintf("fd00::x:%d", a.nextIP6)
+		}
+		return a.ips[ip]
+	})
+}
 
-	var lines []string
-	okAll := true
-	for _, raw := range urls {
-		alive, info := probeRepo(ctx, raw)
-		if alive {
-			lines = append(lines, "[✓] "+info)
-		} else {
-			lines = append(lines, "[x] "+info)
-			okAll = false
+func (a *anonymizer) value(v any) any {
+	switch v := v.(type) {
+	case string:
+		return a.text(v)
+	case []string:
+		out := make([]string, len(v))
+		for i, s := range v {
+			out[i] = a.text(s)
 		}
+		return out
+	case map[string]any:
+		out := make(map[string]any, len(v))
+		for k, x := range v {
+			out[a.text(k)] = a.value(x)
+		}
+		return out
 	}
-	if okAll {
-		return "Repository network reachable", strings.Join(lines, "\n"), true
-	}
-	return "Some repositories are unreachable", strings.Join(lines, "\n"), false
+	return v
 }
 
-func parseRepoURLs(vv, abi string) []string {
-	var out []string
-	for _, ln := range strings.Split(vv, "\n") {
-		line := strings.TrimSpace(ln)
-		if strings.HasPrefix(line, "url") {
-			parts := strings.SplitN(line, ":", 2)
-			if len(parts) != 2 {
-				continue
-			}
-			u := strings.TrimSpace(parts[1])
-			u = strings.TrimRight(u, ",")
-			u = strings.Trim(u, `"'`)
-			u = strings.TrimSpace(u)
-			if strings.HasPrefix(u, "pkg+http://") {
-				u = "http://" + strings.TrimPrefix(u, "pkg+http://")
-			} else if strings.HasPrefix(u, "pkg+https://") {
-				u = "https://" + strings.TrimPrefix(u, "pkg+https://")
-			}
-			u = strings.ReplaceAll(u, "${ABI}", abi)
-			if u != "" {
-				out = append(out, u)
-			}
+func (a *anonymizer) events(events []Event) []Event {
+	out := make([]Event, len(events))
+	for i, ev := range events {
+		ev.Message = a.text(ev.Message)
+		ev.Detail = a.text(ev.Detail)
+		if ev.Data != nil {
+			ev.Data = a.value(ev.Data).(map[string]any)
 		}
+		out[i] = ev
 	}
 	return out
 }
 
-func probeRepo(ctx context.Context, raw string) (bool, string) {
-	u, err := url.Parse(raw)
+func fileSHA256(path string) (string, error) {
+	f, err := os.Open(path)
 	if err != nil {
-		return false, fmt.Sprintf("%s (parse error: %v)", raw, err)
-	}
-	host := u.Host
-	port := "80"
-	if u.Scheme == "https" {
-		port = "443"
+		return "", err
 	}
-	d := net.Dialer{Timeout: 5 * time.Second}
-	conn, err := d.DialContext(ctx, "tcp", net.JoinHostPort(host, port))
-	if err != nil {
-		return false, fmt.Sprintf("%s (tcp connect failed: %v)", raw, err)
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
 	}
-	_ = conn.Close()
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
 
-	client := &http.Client{Timeout: 6 * time.Second}
-	meta := strings.TrimRight(u.String(), "/") + "/meta.conf"
-	resp, err := client.Get(meta)
+// writeChecksum writes a sha256sum-style companion file next to path.
+func writeChecksum(path string) error {
+	sum, err := fileSHA256(path)
 	if err != nil {
-		return false, fmt.Sprintf("%s (GET /meta.conf failed: %v)", raw, err)
-	}
-	defer resp.Body.Close()
-	if resp.StatusCode >= 200 && resp.StatusCode < 400 {
-		return true, fmt.Sprintf("%s (ok)", raw)
+		return err
 	}
-	return false, fmt.Sprintf("%s (GET /meta.conf status %d)", raw, resp.StatusCode)
+	line := sum + "  " + filepath.Base(path) + "\n"
+	return os.WriteFile(path+".sha256", []byte(line), 0644)
 }
 
-// --- Helpers ---
-
-func runCmdCapture(ctx context.Context, name string, args []string) (string, error) {
-	cmd := exec.CommandContext(ctx, name, args...)
-	stdout, err := cmd.StdoutPipe()
+// verifyReport checks path against its companion .sha256 file.
+func verifyReport(path string) error {
+	want, err := os.ReadFile(path + ".sha256")
 	if err != nil {
-		return "", err
+		return err
 	}
-	stderr, err := cmd.StderrPipe()
+	fields := strings.Fields(string(want))
+	if len(fields) == 0 {
+		return fmt.Errorf("%s.sha256 is empty", path)
+	}
+	got, err := fileSHA256(path)
 	if err != nil {
-		return "", err
+		return err
 	}
-	if err := cmd.Start(); err != nil {
-		return "", err
+	if !strings.EqualFold(fields[0], got) {
+		return fmt.Errorf("checksum mismatch: expected %s, got %s", fields[0], got)
 	}
-	merge := io.MultiReader(stdout, stderr)
-	sc := bufio.NewScanner(merge)
-	var b strings.Builder
-	for sc.Scan() {
-		b.WriteString(sc.Text())
-		b.WriteByte('\n')
+	return nil
+}
+
+// writeDebugDump prints the final model's internal state for reproducing
+// TUI-logic bugs. It is separate from the user-facing report.
+func writeDebugDump(w io.Writer, m model) error {
+	dump := struct {
+		Events []Event         `json:"events"`
+		StMap  map[Stage]Event `json:"st_map"`
+		Order  []Stage         `json:"st_order"`
+		Idx    int             `json:"idx"`
+		Done   bool            `json:"done"`
+		Err    string          `json:"err,omitempty"`
+	}{Events: m.events, StMap: m.stMap, Order: m.stOrder, Idx: m.idx, Done: m.done}
+	if m.err != nil {
+		dump.Err = m.err.Error()
 	}
-	if err := sc.Err(); err != nil {
-		return b.String(), err
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(dump)
+}
+
+// logEvent writes ev to syslog, if configured, at a severity derived from
+// its status.
+func logEvent(w *syslog.Writer, ev Event) {
+	if w == nil {
+		return
 	}
-	if err := cmd.Wait(); err != nil {
-		return b.String(), err
+	line := fmt.Sprintf("stage=%s status=%s message=%q", ev.Stage, ev.Status, ev.Message)
+	switch ev.Status {
+	case StatusError:
+		_ = w.Err(line)
+	case StatusWarn:
+		_ = w.Warning(line)
+	default:
+		_ = w.Info(line)
+	}
+}
+
+// eventDuration returns how long the stage behind ev ran, falling back to
+// its timeline timestamps for events without a duration.
+func eventDuration(ev Event) time.Duration {
+	if ev.DurationMs > 0 {
+		return time.Duration(ev.DurationMs) * time.Millisecond
 	}
-	return b.String(), nil
+	start, err1 := time.Parse(timestampMs, ev.Start)
+	end, err2 := time.Parse(timestampMs, ev.End)
+	if err1 != nil || err2 != nil {
+		return 0
+	}
+	return end.Sub(start)
 }
 
-func globRepoSqlite() ([]string, error) {
-	base := "/var/db/pkg"
-	return filepath.Glob(filepath.Join(base, "repo-*.sqlite*"))
+// writeTSV prints one tab-separated line per event for awk/cut pipelines.
+func writeTSV(w io.Writer, events []Event) {
+	clean := strings.NewReplacer("\t", " ", "\n", " ")
+	fmt.Fprintln(w, "stage\tstatus\tduration_ms\tmessage")
+	for _, ev := range events {
+		fmt.Fprintf(w, "%s\t%s\t%d\t%s\n", ev.Stage, ev.Status, eventDuration(ev).Milliseconds(), clean.Replace(ev.Message))
+	}
 }
 
+// writeJSONReport writes events as a JSON array to path, or to stdout when
+// path is "-".
 func writeJSONReport(path string, events []Event) error {
 	if path == "" {
 		return nil
 	}
-	f, err := os.Create(path)
-	if err != nil {
-		return err
+	w := os.Stdout
+	if path != "-" {
+		f, err := os.Create(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
 	}
-	defer f.Close()
-	enc := json.NewEncoder(f)
+	enc := json.NewEncoder(w)
 	enc.SetIndent("", "  ")
 	return enc.Encode(events)
 }
@@ -607,28 +4828,671 @@ func indent(s string) string {
 	return b.String()
 }
 
+// tail returns at most the last max bytes of s. The cut never splits a
+// UTF-8 character, and moves forward to the next line start when that
+// costs less than half of the kept text.
 func tail(s string, max int) string {
 	if len(s) <= max {
 		return s
 	}
-	return s[len(s)-max:]
+	cut := len(s) - max
+	for cut < len(s) && !utf8.RuneStart(s[cut]) {
+		cut++
+	}
+	if i := strings.IndexByte(s[cut:], '\n'); i >= 0 && i < max/2 {
+		cut += i + 1
+	}
+	return s[cut:]
+}
+
+// applyCIPreset turns on CI-friendly defaults for every setting the user
+// did not pass explicitly on the command line.
+func applyCIPreset(cfg *Config) {
+	set := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	if !set["plain"] && !set["no-tui"] {
+		cfg.Plain = true
+	}
+	if !set["no-color"] && !set["force-color"] && !set["color-depth"] {
+		cfg.NoColor = true
+	}
+	if !set["no-spinner"] {
+		cfg.NoSpinner = true
+	}
+	if !set["strict"] {
+		cfg.Strict = true
+	}
+	if !set["report-json"] && !set["report-dir"] {
+		cfg.JSONReport = "ppr-report.json"
+	}
+	cfg.MachineSummary = true
+}
+
+// defaultConfigPath is read, when present, for default option values.
+const defaultConfigPath = "/usr/local/etc/ppr.conf"
+
+// configPath finds --config among args ahead of flag.Parse, since its
+// values must be in place before the command line overrides them. It
+// reports whether the path was given explicitly.
+func configPath(args []string) (string, bool) {
+	for i, a := range args {
+		if a == "--" {
+			break
+		}
+		name, val, hasVal := strings.Cut(strings.TrimLeft(a, "-"), "=")
+		if !strings.HasPrefix(a, "-") || name != "config" {
+			continue
+		}
+		if hasVal {
+			return val, true
+		}
+		if i+1 < len(args) {
+			return args[i+1], true
+		}
+	}
+	return defaultConfigPath, false
+}
+
+// loadConfigFile applies a JSON object of flag names to values, e.g.
+// {"timeout": "30m", "compact": true, "skip": ["clear_repo_cache"]}, as
+// flag defaults. A missing default file is not an error.
+func loadConfigFile(path string, explicit bool) error {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) && !explicit {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var values map[string]any
+	if err := json.Unmarshal(data, &values); err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	for name, v := range values {
+		if name == "config" || flag.Lookup(name) == nil {
+			return fmt.Errorf("%s: unknown option %q", path, name)
+		}
+		var val string
+		switch v := v.(type) {
+		case []any:
+			parts := make([]string, len(v))
+			for i, p := range v {
+				parts[i] = fmt.Sprint(p)
+			}
+			val = strings.Join(parts, ",")
+		case float64:
+			val = strconv.FormatFloat(v, 'f', -1, 64)
+		default:
+			val = fmt.Sprint(v)
+		}
+		if err := flag.Set(name, val); err != nil {
+			return fmt.Errorf("%s: %s: %v", path, name, err)
+		}
+	}
+	return nil
+}
+
+// hideFlags keeps developer-only flags out of -help output.
+func hideFlags(names ...string) {
+	hidden := map[string]bool{}
+	for _, n := range names {
+		hidden[n] = true
+	}
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage of %s:\n", os.Args[0])
+		flag.VisitAll(func(f *flag.Flag) {
+			if hidden[f.Name] {
+				return
+			}
+			name, usage := flag.UnquoteUsage(f)
+			line := "  -" + f.Name
+			if name != "" {
+				line += " " + name
+			}
+			line += "\n    \t" + strings.ReplaceAll(usage, "\n", "\n    \t")
+			if f.DefValue != "" && f.DefValue != "false" && f.DefValue != "0" && f.DefValue != "0s" {
+				line += fmt.Sprintf(" (default %v)", f.DefValue)
+			}
+			fmt.Fprintln(flag.CommandLine.Output(), line)
+		})
+	}
 }
 
 func main() {
+	if len(os.Args) == 3 && os.Args[1] == "verify-report" {
+		if err := verifyReport(os.Args[2]); err != nil {
+			fmt.Fprintf(os.Stderr, "ppr: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("%s: OK\n", os.Args[2])
+		return
+	}
+
 	cfg := Config{}
 	flag.BoolVar(&cfg.DryRun, "dry-run", false, "Show intended actions without making changes")
+	flag.BoolVar(&cfg.CheckOnly, "check-only", false, "Diagnose only; offer to apply repairs afterwards when interactive")
+	ci := flag.Bool("ci", false, "CI preset: plain output, no color or spinner, strict, report to ppr-report.json, summary on stderr")
+	flag.BoolVar(&cfg.Plain, "plain", false, "Plain line-per-event output without the TUI")
+	flag.BoolVar(&cfg.Plain, "no-tui", false, "Same as --plain")
+	flag.BoolVar(&cfg.Strict, "strict", false, "Treat warnings as failures in the exit status")
 	flag.BoolVar(&cfg.Compact, "compact", false, "Compact view mode (minimal output)")
 	flag.StringVar(&cfg.JSONReport, "report-json", "", "Write a JSON event report to this file")
+	ndjsonPath := flag.String("report-ndjson", "", "Append each event to this file as a JSON line as it happens")
 	flag.DurationVar(&cfg.Timeout, "timeout", 20*time.Minute, "Overall timeout for repair")
+	flag.DurationVar(&cfg.StageTimeout, "stage-timeout", 0, "Timeout for each individual stage (0 = only --timeout)")
+	useSyslog := flag.Bool("syslog", false, "Also log each event to syslog")
+	flag.StringVar(&cfg.SyslogAddr, "syslog-addr", "", "Remote syslog server host:port (UDP); default is the local syslog")
+	flag.BoolVar(&cfg.Anonymize, "anonymize", false, "Replace hostnames and IP addresses in the report with stable pseudonyms")
+	flag.StringVar(&cfg.ReportDir, "report-dir", "", "Write a timestamped JSON report for each run into this directory")
+	flag.DurationVar(&cfg.Repeat, "repeat", 0, "Re-run the pipeline at this interval until interrupted")
+	flag.StringVar(&cfg.OnComplete, "on-complete", "", "When a run ends: quit, wait (for a keypress) or repeat (needs --repeat)")
+	flag.BoolVar(&cfg.Checksum, "report-checksum", false, "Write a .sha256 file alongside the JSON report")
+	flag.BoolVar(&cfg.LockWait, "lock-wait", false, "Wait for another running ppr instance instead of exiting")
+	flag.BoolVar(&cfg.Facts, "system-facts", false, "Collect sysctl and network facts into the report")
+	flag.BoolVar(&cfg.NoColor, "no-color", false, "Disable colored output")
+	flag.BoolVar(&cfg.ForceColor, "force-color", false, "Force colored output even if the terminal does not advertise it")
+	flag.StringVar(&cfg.ColorDepth, "color-depth", "", "Force the color palette: truecolor, 256, 16 or none")
+	flag.BoolVar(&cfg.Timeline, "timeline", false, "Show a timeline of stage durations when the run completes")
+	flag.BoolVar(&cfg.NoSpinner, "no-spinner", false, "Replace the animated spinner with a static marker")
+	flag.BoolVar(&cfg.EditConfig, "edit-config", false, "Offer to open a broken repo config in $EDITOR (interactive only)")
+	flag.BoolVar(&cfg.CatalogSize, "catalog-size", false, "Estimate the catalog download size of each repository")
+	flag.BoolVar(&cfg.Offline, "no-network", false, "Offline mode: skip all network-dependent stages")
+	flag.StringVar(&cfg.SetBranch, "set-branch", "", "Point the repo configs at this branch (quarterly or latest) and exit")
+	flag.BoolVar(&cfg.Restore, "restore", false, "Put the most recent local.sqlite backup back instead of repairing")
+	flag.BoolVar(&cfg.Force, "force", false, "With -restore, overwrite an existing local.sqlite")
+	flag.BoolVar(&cfg.Yes, "yes", false, "Move local.sqlite aside (and, with -upgrade, upgrade) without asking")
+	flag.BoolVar(&cfg.Audit, "audit", false, "Check installed packages for known vulnerabilities with pkg audit -F")
+	flag.BoolVar(&cfg.AuditFail, "audit-fail", false, "Run -audit and exit 1 when vulnerable packages are found")
+	flag.BoolVar(&cfg.Clean, "clean", false, "Also delete cached package archives with pkg clean -a")
+	flag.BoolVar(&cfg.Upgrade, "upgrade", false, "Finish the repair with pkg upgrade -y")
+	jail := flag.String("jail", "", "Repair inside this running jail (pkg -j, jexec)")
+	rootdir := flag.String("rootdir", "", "Repair the jail or system mounted at this directory (runs pkg -c)")
+	flag.StringVar(&cfg.Remote, "remote", "", "Repair user@host[:port] over SSH instead of this machine")
+	flag.StringVar(&cfg.SmokePkg, "smoke-test", "", "Finish by resolving this package (e.g. pkg) from the remote catalog")
+	flag.StringVar(&cfg.VerifyCmd, "verify-cmd", "", "Shell command to run as a final health check")
+	flag.StringVar(&cfg.PreHook, "pre-hook", "", "Shell command to run before the first stage")
+	flag.StringVar(&cfg.PostHook, "post-hook", "", "Shell command to run after the last stage; PPR_STATUS holds ok, info, warn, skip or error")
+	flag.BoolVar(&cfg.DeepCheck, "deep-check", false, "Also check that each mirror serves its packagesite and data catalog archives")
+	flag.BoolVar(&cfg.ProbeViaPkg, "probe-via-pkg", false, "Probe repositories through pkg's fetch backend instead of Go's HTTP client")
+	flag.BoolVar(&cfg.Suggest, "suggest-commands", false, "Print the equivalent shell commands after the run")
+	flag.IntVar(&cfg.ProbeRetries, "probe-retries", 2, "Retry a failed mirror probe up to n times, with exponential backoff")
+	flag.IntVar(&cfg.RunRetries, "run-retries", 0, "Re-run the whole pipeline up to n times after a transient network failure")
+	flag.StringVar(&cfg.RepoConf, "repo-conf", "", "Parse repositories from this pkg repo config file instead of pkg -vv")
+	debugDump := flag.Bool("debug-dump", false, "")
+	hideFlags("debug-dump")
+	flag.String("config", defaultConfigPath, "Read default option values from this JSON file; flags override it")
+	cachePatterns := flag.String("cache-patterns", "", "Comma-separated catalog file patterns to clear under /var/db/pkg (default repo-*.sqlite*)")
+	dnsSeverity := flag.String("dns-severity", "", "Status for failed DNS lookups: error, warn or info (default warn, info when repos are IP-pinned)")
+	flag.StringVar(&cfg.Format, "format", "", "Also print results in a machine format after the run: tsv")
+	dumpVV := flag.Bool("dump-pkg-vv", false, "Print the raw pkg -vv output and exit")
+	only := flag.String("only", "", "Run only these comma-separated stages (e.g. repo_network_check,clear_repo_cache)")
+	skip := flag.String("skip", "", "Run every stage except these comma-separated ones")
+	pick := flag.Bool("select", false, "Choose which stages to run from a checklist before starting")
+	rankMirrors := flag.Bool("suggest-mirror", false, "Rank the configured and known mirrors by latency, suggest the best and exit")
+	repoRegex := flag.String("repo-regex", "", "Only probe repositories whose name matches this regular expression")
+	slowMs := flag.Int("slow-mirror-ms", 0, "Warn when a mirror probe takes longer than this many milliseconds (0 = off)")
+	if path, explicit := configPath(os.Args[1:]); path != "" {
+		if err := loadConfigFile(path, explicit); err != nil {
+			fmt.Fprintf(os.Stderr, "ppr: %v\n", err)
+			os.Exit(2)
+		}
+	}
 	flag.Parse()
+	if *ci {
+		applyCIPreset(&cfg)
+	}
+	cfg.SlowMirror = time.Duration(*slowMs) * time.Millisecond
+	cfg.Audit = cfg.Audit || cfg.AuditFail
+	switch {
+	case cfg.SetBranch != "" && cfg.SetBranch != "quarterly" && cfg.SetBranch != "latest":
+		fmt.Fprintf(os.Stderr, "ppr: invalid --set-branch %q (want quarterly or latest)\n", cfg.SetBranch)
+		os.Exit(2)
+	case cfg.SetBranch != "" && cfg.Restore:
+		fmt.Fprintln(os.Stderr, "ppr: --set-branch cannot be combined with --restore")
+		os.Exit(2)
+	}
+	if cfg.ProbeRetries < 0 {
+		fmt.Fprintf(os.Stderr, "ppr: invalid --probe-retries %d (want 0 or more)\n", cfg.ProbeRetries)
+		os.Exit(2)
+	}
+	if cfg.Format != "" && cfg.Format != "tsv" {
+		fmt.Fprintf(os.Stderr, "ppr: invalid --format %q (want tsv)\n", cfg.Format)
+		os.Exit(2)
+	}
+	switch s := Status(*dnsSeverity); s {
+	case "", StatusError, StatusWarn, StatusInfo:
+		cfg.DNSSeverity = s
+	default:
+		fmt.Fprintf(os.Stderr, "ppr: invalid --dns-severity %q (want error, warn or info)\n", *dnsSeverity)
+		os.Exit(2)
+	}
+	for _, pat := range strings.Split(*cachePatterns, ",") {
+		if pat = strings.TrimSpace(pat); pat != "" {
+			cfg.CacheGlobs = append(cfg.CacheGlobs, pat)
+		}
+	}
+	if *repoRegex != "" {
+		re, err := regexp.Compile(*repoRegex)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "ppr: invalid --repo-regex: %v\n", err)
+			os.Exit(2)
+		}
+		cfg.RepoRegex = re
+	}
 
-	p := tea.NewProgram(initialModel(cfg))
-	final, err := p.Run()
-	if err != nil {
+	switch cfg.OnComplete {
+	case "":
+		cfg.OnComplete = "quit"
+		if cfg.Repeat > 0 {
+			cfg.OnComplete = "repeat"
+		}
+	case "repeat":
+		if cfg.Repeat <= 0 {
+			fmt.Fprintln(os.Stderr, "ppr: --on-complete=repeat needs --repeat <interval>")
+			os.Exit(2)
+		}
+	case "quit", "wait":
+		if cfg.Repeat > 0 {
+			fmt.Fprintf(os.Stderr, "ppr: --repeat conflicts with --on-complete=%s\n", cfg.OnComplete)
+			os.Exit(2)
+		}
+	default:
+		fmt.Fprintf(os.Stderr, "ppr: invalid --on-complete %q (want quit, wait or repeat)\n", cfg.OnComplete)
+		os.Exit(2)
+	}
+	if *jail != "" {
+		if *rootdir != "" {
+			fmt.Fprintln(os.Stderr, "ppr: --jail and --rootdir cannot be combined")
+			os.Exit(2)
+		}
+		jailName = *jail
+		// Probe from inside the jail, whose network may differ: fetch(1)
+		// is looked up and run there through jexec.
+		cfg.ProbeViaPkg = true
+	}
+	if *rootdir != "" {
+		if fi, err := os.Stat(*rootdir); cfg.Remote == "" && (err != nil || !fi.IsDir()) {
+			fmt.Fprintf(os.Stderr, "ppr: --rootdir %s is not a directory\n", *rootdir)
+			os.Exit(2)
+		}
+		useRootDir(filepath.Clean(*rootdir))
+	}
+	if _, ok := colorDepths[cfg.ColorDepth]; cfg.ColorDepth != "" && !ok {
+		fmt.Fprintf(os.Stderr, "ppr: invalid --color-depth %q (want truecolor, 256, 16 or none)\n", cfg.ColorDepth)
+		os.Exit(2)
+	}
+	if cfg.JSONReport == "-" {
+		if cfg.Checksum {
+			fmt.Fprintln(os.Stderr, "ppr: --report-checksum needs a report file, not stdout")
+			os.Exit(2)
+		}
+		// The TUI would mix escape codes into the JSON.
+		cfg.Plain = true
+	}
+	if err := checkReportPath(reportPath(cfg, time.Now())); err != nil {
+		fmt.Fprintf(os.Stderr, "ppr: %v\n", err)
+		os.Exit(2)
+	}
+	configureColor(cfg)
+
+	if cfg.Remote != "" {
+		r, err := dialRemote(cfg.Remote)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "ppr: remote %s: %v\n", cfg.Remote, err)
+			os.Exit(1)
+		}
+		defer r.client.Close()
+		remote = r
+		// Probe from the target host, not from this workstation.
+		cfg.ProbeViaPkg = true
+	}
+
+	if *dumpVV {
+		out, err := runCmdCapture(context.Background(), "pkg", []string{"-vv"})
+		fmt.Print(out)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "ppr: pkg -vv: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+	if *rankMirrors {
+		ctx, cancel := context.Background(), context.CancelFunc(func() {})
+		if cfg.Timeout > 0 {
+			ctx, cancel = context.WithTimeout(ctx, cfg.Timeout)
+		}
+		defer cancel()
+		if !suggestMirror(ctx, cfg, os.Stdout) {
+			os.Exit(1)
+		}
+		return
+	}
+
+	if *only != "" || *skip != "" {
+		if *only != "" && *skip != "" || *pick {
+			fmt.Fprintln(os.Stderr, "ppr: --only, --skip and --select cannot be combined")
+			os.Exit(2)
+		}
+		list, err := parseStageList(*only + *skip)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "ppr: %v (known: %s)\n", err, joinStages(pipelineStages))
+			os.Exit(2)
+		}
+		cfg.Stages = list
+		if *skip != "" {
+			cfg.Stages = map[Stage]bool{}
+			for _, st := range pipeline(cfg) {
+				cfg.Stages[st] = !list[st]
+			}
+		}
+		if !slices.ContainsFunc(pipeline(cfg), func(st Stage) bool { return cfg.Stages[st] }) {
+			fmt.Fprintln(os.Stderr, "ppr: no stages left to run")
+			os.Exit(2)
+		}
+	}
+	if *pick {
+		if cfg.Plain || !isInteractive() {
+			fmt.Fprintln(os.Stderr, "ppr: --select needs an interactive terminal")
+			os.Exit(2)
+		}
+		stages, ok := selectStages(cfg)
+		if !ok {
+			os.Exit(130)
+		}
+		if len(stages) == 0 {
+			fmt.Fprintln(os.Stderr, "ppr: no stages selected")
+			os.Exit(2)
+		}
+		cfg.Stages = stages
+	}
+
+	if *ndjsonPath != "" {
+		// Pseudonyms are assigned from the whole run, which a streamed
+		// log does not wait for.
+		if cfg.Anonymize {
+			fmt.Fprintln(os.Stderr, "ppr: --report-ndjson cannot be combined with --anonymize")
+			os.Exit(2)
+		}
+		f, err := os.OpenFile(*ndjsonPath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "ppr: %v\n", err)
+			os.Exit(1)
+		}
+		defer f.Close()
+		cfg.NDJSON = f
+	}
+
+	if *useSyslog || cfg.SyslogAddr != "" {
+		network := ""
+		if cfg.SyslogAddr != "" {
+			network = "udp"
+		}
+		w, err := syslog.Dial(network, cfg.SyslogAddr, syslog.LOG_INFO|syslog.LOG_DAEMON, "ppr")
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "ppr: syslog: %v\n", err)
+			os.Exit(1)
+		}
+		defer w.Close()
+		cfg.Syslog = w
+	}
+
+	// Without permission to create the lock we also lack permission to
+	// touch the pkg database, so the run is read-only and safe to continue.
+	lock, err := acquireLock(lockPath, cfg.LockWait)
+	if err != nil && !os.IsPermission(err) {
 		fmt.Fprintf(os.Stderr, "ppr: %v\n", err)
 		os.Exit(1)
 	}
-	if m, ok := final.(model); ok && m.err != nil {
+	if lock != nil {
+		defer lock.Close()
+	}
+
+	// With the report on stdout everything else goes to stderr, so the
+	// JSON can be piped on its own.
+	var out io.Writer = os.Stdout
+	if cfg.JSONReport == "-" {
+		out = os.Stderr
+	}
+	var history []string
+	for {
+		run := cfg
+		run.JSONReport = reportPath(cfg, time.Now())
+		run.History = history
+		m, ok := runWithRetries(run)
+		if !ok {
+			return
+		}
+		if cfg.Format == "tsv" {
+			writeTSV(out, m.events)
+		}
+		if cfg.Suggest {
+			writeSuggestedCommands(out, m.events)
+		}
+		if *debugDump {
+			_ = writeDebugDump(os.Stderr, m)
+		}
+		if m.reportErr != nil {
+			fmt.Fprintf(os.Stderr, "ppr: report %s: %v\n", run.JSONReport, m.reportErr)
+		}
+		if cfg.OnComplete != "repeat" || m.aborted {
+			code := exitCode(m)
+			if cfg.MachineSummary {
+				fmt.Fprintln(os.Stderr, machineSummary(m, code))
+			}
+			if code != 0 {
+				fmt.Fprintln(os.Stderr, exitExplanation(code, m))
+				os.Exit(code)
+			}
+			return
+		}
+		history = append(history, runSummary(time.Now(), m))
+		if len(history) > maxHistory {
+			history = history[len(history)-maxHistory:]
+		}
+		fmt.Fprintf(os.Stderr, "ppr: next run in %s (ctrl-c to stop)\n", cfg.Repeat)
+		time.Sleep(cfg.Repeat)
+	}
+}
+
+// --- Stage selection ---
+
+// selectModel is the --select checklist shown before the run.
+type selectModel struct {
+	stages    []Stage
+	on        []bool
+	cursor    int
+	style     styles
+	confirmed bool
+}
+
+// selectStages lets the user pick the stages to run, all checked except
+// the last-resort move of local.sqlite. It returns false if the user quit.
+func selectStages(cfg Config) (map[Stage]bool, bool) {
+	m := selectModel{stages: pipeline(cfg), style: newStyles(plainStyles(cfg))}
+	for _, st := range m.stages {
+		m.on = append(m.on, st != StageMoveLocalDB)
+	}
+	final, err := tea.NewProgram(m).Run()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ppr: %v\n", err)
 		os.Exit(1)
 	}
+	m = final.(selectModel)
+	if !m.confirmed {
+		return nil, false
+	}
+	picked := map[Stage]bool{}
+	for i, st := range m.stages {
+		if m.on[i] {
+			picked[st] = true
+		}
+	}
+	return picked, true
+}
+
+func (m selectModel) Init() tea.Cmd { return nil }
+
+func (m selectModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
+	key, ok := msg.(tea.KeyMsg)
+	if !ok {
+		return m, nil
+	}
+	switch key.String() {
+	case "up", "k":
+		m.cursor = max(m.cursor-1, 0)
+	case "down", "j":
+		m.cursor = min(m.cursor+1, len(m.stages)-1)
+	case " ", "x":
+		m.on[m.cursor] = !m.on[m.cursor]
+	case "enter":
+		m.confirmed = true
+		return m, tea.Quit
+	case "q", "esc", "ctrl+c":
+		return m, tea.Quit
+	}
+	return m, nil
+}
+
+func (m selectModel) View() string {
+	if m.confirmed {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteString(m.style.section.Render("Select the stages to run"))
+	b.WriteString("\n")
+	for i, st := range m.stages {
+		cursor, box := "  ", "[ ]"
+		if i == m.cursor {
+			cursor = "> "
+		}
+		if m.on[i] {
+			box = "[x]"
+		}
+		line := cursor + box + " " + humanStage(st)
+		if i == m.cursor {
+			line = m.style.ok.Render(line)
+		}
+		b.WriteString(line + "\n")
+	}
+	b.WriteString(m.style.detail.Render("space toggles, enter runs, q quits"))
+	b.WriteString("\n")
+	return b.String()
+}
+
+// runWithRetries runs the pipeline once, re-running it up to
+// cfg.RunRetries times while failures look transient.
+func runWithRetries(cfg Config) (model, bool) {
+	var m model
+	var ok bool
+	backoff := 30 * time.Second
+	for cfg.Attempt = 1; ; cfg.Attempt++ {
+		if cfg.Plain {
+			// Keep stdout clean for a report written there.
+			w := os.Stdout
+			if cfg.JSONReport == "-" {
+				w = os.Stderr
+			}
+			m, ok = runPlain(cfg, w), true
+		} else {
+			p := tea.NewProgram(initialModel(cfg))
+			final, err := p.Run()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "ppr: %v\n", err)
+				os.Exit(1)
+			}
+			m, ok = final.(model)
+		}
+		if !ok || m.aborted || cfg.Attempt > cfg.RunRetries || !isTransientFailure(m.events) {
+			return m, ok
+		}
+		fmt.Fprintf(os.Stderr, "ppr: transient network failure, retrying in %s (attempt %d of %d)\n",
+			backoff, cfg.Attempt+1, cfg.RunRetries+1)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// runPlain runs the pipeline without the TUI, printing one plain line per
+// event. Interactive prompts never appear in this mode.
+func runPlain(cfg Config, w io.Writer) model {
+	m := initialModel(cfg)
+	for ; m.idx < len(m.stOrder); m.idx++ {
+		ev, ok := m.startStage()().(eventMsg)
+		if !ok {
+			continue
+		}
+		m.record(Event(ev))
+		m.stMap[ev.Stage] = Event(ev)
+		fmt.Fprintln(w, plainLine(Event(ev)))
+		if m.ctx.Err() != nil || blocksRun(Event(ev)) {
+			break
+		}
+	}
+	n := len(m.events)
+	m, _ = m.finish()
+	for _, ev := range m.events[n:] {
+		if ev.Stage == StagePostHook {
+			fmt.Fprintln(w, plainLine(ev))
+		}
+	}
+	if cfg.DryRun {
+		fmt.Fprintln(w, "Dry-run plan (no changes were made):")
+		for _, l := range dryRunPlan(m.events) {
+			fmt.Fprintln(w, l)
+		}
+	}
+	return m
+}
+
+// plainLine renders ev as one greppable, timestamped log line.
+func plainLine(ev Event) string {
+	line := ev.Time + " " + statusIcon(ev.Status) + " " + humanStage(ev.Stage)
+	if ev.Message != "" {
+		line += ": " + ev.Message
+	}
+	return line
+}
+
+// machineSummary is the single stderr line --ci prints for log scrapers.
+func machineSummary(m model, code int) string {
+	counts := map[Status]int{}
+	for _, ev := range m.events {
+		counts[ev.Status]++
+	}
+	return fmt.Sprintf("ppr-summary status=%s exit=%d ok=%d info=%d warn=%d error=%d skip=%d",
+		worstStatus(m.events), code, counts[StatusOK], counts[StatusInfo], counts[StatusWarn], counts[StatusError], counts[StatusSkip])
+}
+
+// maxHistory is how many previous --repeat runs the header lists.
+const maxHistory = 5
+
+// runSummary condenses a finished run into one history line.
+func runSummary(t time.Time, m model) string {
+	worst := worstStatus(m.events)
+	line := fmt.Sprintf("%s %s %s", t.Format("15:04:05"), statusIcon(worst), worst)
+	for _, ev := range m.events {
+		if ev.Status == worst && worst != StatusOK {
+			line += " — " + humanStage(ev.Stage) + ": " + ev.Message
+			break
+		}
+	}
+	return line
+}
+
+// reportPath picks the JSON report file for a run starting at t. With
+// --report-dir every run gets its own timestamped file; with --repeat a
+// fixed --report-json name is timestamped so runs do not overwrite each
+// other.
+func reportPath(cfg Config, t time.Time) string {
+	stamp := t.Format("20060102-150405")
+	switch {
+	case cfg.JSONReport == "-":
+		return "-"
+	case cfg.ReportDir != "":
+		return filepath.Join(cfg.ReportDir, "ppr-"+stamp+".json")
+	case cfg.Repeat > 0 && cfg.JSONReport != "":
+		ext := filepath.Ext(cfg.JSONReport)
+		return strings.TrimSuffix(cfg.JSONReport, ext) + "-" + stamp + ext
+	}
+	return cfg.JSONReport
 }
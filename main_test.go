@@ -0,0 +1,548 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	tea "github.com/charmbracelet/bubbletea"
+)
+
+func TestCaptureLongLine(t *testing.T) {
+	const size = 1 << 20
+	out, errOut, err := runCmdCaptureSplit(context.Background(), "sh", []string{"-c", `head -c 1048576 /dev/zero | tr "\0" a`})
+	if err != nil {
+		t.Fatalf("runCmdCaptureSplit: %v", err)
+	}
+	if errOut != "" {
+		t.Errorf("stderr = %q, want empty", errOut)
+	}
+	if want := strings.Repeat("a", size) + "\n"; out != want {
+		t.Errorf("got %d bytes (%d lines), want one %d-byte line", len(out), strings.Count(out, "\n"), size)
+	}
+}
+
+func TestScanLines(t *testing.T) {
+	long := strings.Repeat("x", 1<<20)
+	tests := []struct {
+		name, in, want string
+	}{
+		{"empty", "", ""},
+		{"no trailing newline", "a\nb", "a\nb\n"},
+		{"crlf", "a\r\nb\r\n", "a\nb\n"},
+		{"1MB line", long, long + "\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := scanLines(strings.NewReader(tt.in))
+			if err != nil {
+				t.Fatalf("scanLines: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("got %d bytes, want %d", len(got), len(tt.want))
+			}
+		})
+	}
+}
+
+func TestParseReposURLForms(t *testing.T) {
+	const abi = "FreeBSD:14:amd64"
+	tests := []struct {
+		name string
+		conf string
+		want []Repo
+	}{
+		{
+			name: "unquoted",
+			conf: "FreeBSD: {\nurl: pkg+http://pkg.example.org/repo\n}",
+			want: []Repo{{Name: "FreeBSD", URL: "http://pkg.example.org/repo"}},
+		},
+		{
+			name: "quoted value",
+			conf: "FreeBSD: {\nurl: \"pkg+https://pkg.example.org/repo\",\n}",
+			want: []Repo{{Name: "FreeBSD", URL: "https://pkg.example.org/repo"}},
+		},
+		{
+			name: "quoted key",
+			conf: "FreeBSD: {\n\"url\" = \"https://pkg.example.org/repo\"\n}",
+			want: []Repo{{Name: "FreeBSD", URL: "https://pkg.example.org/repo"}},
+		},
+		{
+			name: "indented",
+			conf: "FreeBSD: {\n    url: \"pkg+http://pkg.example.org/repo\",\n    enabled: yes\n  }",
+			want: []Repo{{Name: "FreeBSD", URL: "http://pkg.example.org/repo"}},
+		},
+		{
+			name: "pkg -vv spacing",
+			conf: "Repositories:\n  FreeBSD: { \n    url             : \"pkg+https://pkg.example.org/repo\",\n    enabled         : yes,\n  }",
+			want: []Repo{{Name: "FreeBSD", URL: "https://pkg.example.org/repo"}},
+		},
+		{
+			name: "quoted block name",
+			conf: "\"FreeBSD\": {\n  url: \"pkg+http://pkg.example.org/repo\"\n}",
+			want: []Repo{{Name: "FreeBSD", URL: "http://pkg.example.org/repo"}},
+		},
+		{
+			name: "abi substituted",
+			conf: "FreeBSD: {\n  url: \"pkg+http://pkg.example.org/${ABI}/quarterly\"\n}",
+			want: []Repo{{
+				Name:    "FreeBSD",
+				URL:     "http://pkg.example.org/" + abi + "/quarterly",
+				ABIBase: "http://pkg.example.org/",
+				ABI:     abi,
+			}},
+		},
+		{
+			name: "not a url key",
+			conf: "FreeBSD: {\n  mirror_url: \"http://pkg.example.org/repo\"\n  urls: x\n}",
+			want: nil,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := parseRepos(tt.conf, abi)
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("parseRepos() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestProbeRepoSchemes(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/repo/meta.conf" {
+			http.NotFound(w, r)
+			return
+		}
+		io.WriteString(w, "version = 2;\npacking_format = \"tzst\";\n")
+	}))
+	defer srv.Close()
+	tlsSrv := httptest.NewTLSServer(srv.Config.Handler)
+	defer tlsSrv.Close()
+
+	repo := t.TempDir()
+	if err := os.WriteFile(filepath.Join(repo, "meta.conf"), []byte("version = 2;\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	empty := t.TempDir()
+
+	tests := []struct {
+		name   string
+		url    string
+		want   Status
+		detail string
+	}{
+		{"http", srv.URL + "/repo", StatusOK, "(ok, HTTP/1.1"},
+		{"pkg+http", "pkg+" + srv.URL + "/repo", StatusOK, "(ok, HTTP/1.1"},
+		{"http missing", srv.URL + "/gone", StatusError, "status 404"},
+		// The test server's certificate is not trusted, which proves the
+		// probe went through TLS.
+		{"https", tlsSrv.URL + "/repo", StatusError, "certificate"},
+		{"pkg+https", "pkg+" + tlsSrv.URL + "/repo", StatusError, "certificate"},
+		{"file", "file://" + repo, StatusOK, "(ok, local)"},
+		{"pkg+file", "pkg+file://" + repo, StatusOK, "(ok, local)"},
+		{"file without meta.conf", "file://" + empty, StatusError, "no meta.conf"},
+		{"file missing", "file://" + filepath.Join(empty, "nope"), StatusError, "no such file"},
+		{"ftp", "ftp://ftp.example.org/pub", StatusSkip, "ftp scheme not probed"},
+		{"pkg+ftp", "pkg+ftp://ftp.example.org/pub", StatusSkip, "ftp scheme not probed"},
+		{"unsupported", "gopher://example.org/repo", StatusError, `unsupported scheme "gopher"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, detail := probeRepo(context.Background(), tt.url)
+			if got != tt.want || !strings.Contains(detail, tt.detail) {
+				t.Errorf("probeRepo(%q) = %s, %q; want %s containing %q", tt.url, got, detail, tt.want, tt.detail)
+			}
+		})
+	}
+}
+
+func TestTargetCommand(t *testing.T) {
+	defer func(j, r string) { jailName, rootDir = j, r }(jailName, rootDir)
+	tests := []struct {
+		name, jail, root string
+		cmd              string
+		args             []string
+		want             []string
+	}{
+		{"host", "", "", "fetch", []string{"-q", "url"}, []string{"fetch", "-q", "url"}},
+		{"jail pkg", "web", "", "pkg", []string{"update"}, []string{"pkg", "-j", "web", "update"}},
+		// The probe's fetch(1) lookup and the fetch itself must run in
+		// the jail, whose network and tools may differ from the host's.
+		{"jail lookup", "web", "", "sh", []string{"-c", "command -v fetch"}, []string{"jexec", "web", "sh", "-c", "command -v fetch"}},
+		{"jail fetch", "web", "", "fetch", []string{"-q", "url"}, []string{"jexec", "web", "fetch", "-q", "url"}},
+		{"rootdir pkg", "", "/mnt", "pkg", []string{"update"}, []string{"pkg", "-c", "/mnt", "update"}},
+		{"rootdir other", "", "/mnt", "fetch", []string{"-q", "url"}, []string{"fetch", "-q", "url"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			jailName, rootDir = tt.jail, tt.root
+			name, args := targetCommand(tt.cmd, tt.args)
+			if got := append([]string{name}, args...); !slices.Equal(got, tt.want) {
+				t.Errorf("targetCommand() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReplaceFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "FreeBSD.conf")
+	if err := os.WriteFile(path, []byte("old"), 0o640); err != nil {
+		t.Fatal(err)
+	}
+	if err := replaceFile(path, []byte("new")); err != nil {
+		t.Fatalf("replaceFile: %v", err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil || string(data) != "new" {
+		t.Errorf("content = %q, %v; want \"new\"", data, err)
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0o640 {
+		t.Errorf("mode = %v, want 0640", fi.Mode().Perm())
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Errorf("temporary file left behind: %v", entries)
+	}
+	if err := replaceFile(filepath.Join(dir, "missing.conf"), []byte("x")); err == nil {
+		t.Error("replaceFile of a missing file succeeded")
+	}
+}
+
+func TestRerunReplacesReportEvent(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "report.json")
+	m := initialModel(Config{JSONReport: path})
+	m.settle(Event{Stage: StageRepoNet, Status: StatusError, Attempts: 1})
+	m.retrying = true
+	m.settle(Event{Stage: StageRepoNet, Status: StatusOK, Attempts: 1})
+	if err := m.closeSinks(); err != nil {
+		t.Fatalf("closeSinks: %v", err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var events []Event
+	if err := json.Unmarshal(data, &events); err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 || events[0].Status != StatusOK || events[0].Attempts != 2 {
+		t.Errorf("report = %+v, want one ok event after 2 attempts", events)
+	}
+}
+
+func TestSkipOnlyWhileInFlight(t *testing.T) {
+	m := initialModel(Config{Plain: true})
+	m.stOrder = []Stage{StagePkgUpdate, StagePkgCheckDA, StagePkgRecompute}
+	m.stageCtx()
+	key := tea.KeyMsg{Type: tea.KeyRunes, Runes: []rune{'s'}}
+
+	// The first stage finishes; its nextStageMsg has not arrived yet.
+	next, _ := m.Update(eventMsg{Stage: StagePkgUpdate, Status: StatusOK})
+	next, cmd := next.(model).Update(key)
+	if cmd != nil || len(next.(model).events) != 1 {
+		t.Fatalf("s after the stage finished: events %+v, cmd %v", next.(model).events, cmd != nil)
+	}
+
+	// The second stage is dispatched and skipped while running.
+	next, _ = next.(model).Update(nextStageMsg{})
+	next, cmd = next.(model).Update(key)
+	m = next.(model)
+	if cmd == nil || len(m.events) != 2 || m.events[1].Stage != StagePkgCheckDA || m.events[1].SkipReason != SkipUserExcluded {
+		t.Fatalf("s while running: events %+v", m.events)
+	}
+	// Its late result is dropped, and a second s does nothing.
+	next, _ = m.Update(eventMsg{Stage: StagePkgCheckDA, Status: StatusOK})
+	if next, cmd = next.(model).Update(key); cmd != nil || len(next.(model).events) != 2 {
+		t.Errorf("second s: events %+v", next.(model).events)
+	}
+}
+
+func TestPostHookRunsWhenRunEndsEarly(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "status")
+	m := initialModel(Config{Plain: true, PreHook: "true", PostHook: `echo "$PPR_STATUS" > ` + out})
+	m.stOrder = []Stage{StagePreHook, StagePkgLock, StagePostHook}
+	m.settle(Event{Stage: StagePreHook, Status: StatusOK})
+	m.stMap[StagePreHook] = m.events[0]
+	m.idx = 1
+	m, _ = m.abort()
+	data, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatalf("post-hook did not run: %v", err)
+	}
+	if got := strings.TrimSpace(string(data)); got != "error" {
+		t.Errorf("PPR_STATUS = %q, want error", got)
+	}
+	if ev, ok := m.stMap[StagePostHook]; !ok || ev.Status != StatusOK {
+		t.Errorf("post-hook event = %+v", ev)
+	}
+}
+
+func TestProbeRepoSingleRequest(t *testing.T) {
+	var methods []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		methods = append(methods, r.Method)
+		if r.URL.Path == "/portal/meta.conf" {
+			w.Header().Set("Content-Type", "text/html")
+			io.WriteString(w, "<html>Please log in</html>")
+			return
+		}
+		io.WriteString(w, "version = 2;\n")
+	}))
+	defer srv.Close()
+
+	if st, info := probeRepo(context.Background(), srv.URL+"/repo"); st != StatusOK {
+		t.Errorf("healthy mirror: %s, %s", st, info)
+	}
+	if !slices.Equal(methods, []string{http.MethodGet}) {
+		t.Errorf("healthy mirror requests = %v, want one GET", methods)
+	}
+	st, info := probeRepo(context.Background(), srv.URL+"/portal")
+	if st != StatusWarn || !strings.Contains(info, "meta.conf content unexpected, text/html") {
+		t.Errorf("captive portal: %s, %s", st, info)
+	}
+}
+
+func TestCheckKeysPerms(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("key ownership checks need root")
+	}
+	dir := filepath.Join(t.TempDir(), "pkg")
+	if msg, _, ok := checkKeysPerms(dir); ok || msg != "pkg keys directory missing; reinstall pkg" {
+		t.Errorf("missing directory: %q, %v", msg, ok)
+	}
+	if err := os.MkdirAll(filepath.Join(dir, "trusted"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	key := filepath.Join(dir, "trusted", "pkg.freebsd.org.2013102301")
+	if err := os.WriteFile(key, []byte("function: sha256\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if msg, _, ok := checkKeysPerms(dir); !ok {
+		t.Errorf("readable keys: %q", msg)
+	}
+	if err := os.Chmod(key, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if msg, detail, ok := checkKeysPerms(dir); ok || !strings.Contains(detail, "not readable by pkg") || !strings.Contains(detail, "chown") {
+		t.Errorf("unreadable key: %q, %q", msg, detail)
+	}
+}
+
+func TestRepoConfFileUnderRootDir(t *testing.T) {
+	defer func(r string) { rootDir = r }(rootDir)
+	rootDir = t.TempDir()
+	dir := filepath.Join(rootDir, "usr/local/etc/pkg/repos")
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	conf := filepath.Join(dir, "PPRTest.conf")
+	if err := os.WriteFile(conf, []byte("PPRTest: {\n  url: \"pkg+http://pkg.example.org/${ABI}/latest\"\n}\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	// The edit prompt and --set-branch must find the root's file, not
+	// the host's.
+	if got := repoConfFile(Config{}, []string{"PPRTest"}); got != conf {
+		t.Errorf("repoConfFile() = %q, want %q", got, conf)
+	}
+	rootDir = ""
+	if got := repoConfFile(Config{}, []string{"PPRTest"}); got != "" {
+		t.Errorf("repoConfFile() without --rootdir = %q, want none", got)
+	}
+}
+
+func TestTotalDNSFailureSkipsProbe(t *testing.T) {
+	m := initialModel(Config{Plain: true, DNSSeverity: StatusInfo})
+	m.stOrder = []Stage{StageDNSCheck, StageRepoNet}
+	m.stMap[StageDNSCheck] = Event{Stage: StageDNSCheck, Status: StatusInfo, Data: map[string]any{"all_failed": true}}
+	m.idx = 1
+	ev, ok := m.startStage()().(eventMsg)
+	if !ok || ev.Stage != StageRepoNet || ev.Status != StatusSkip || ev.SkipReason != SkipDependency {
+		t.Errorf("startStage() = %+v, want the network probe skipped", ev)
+	}
+}
+
+func TestCheckCatalog(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/full/packagesite.pkg" && r.URL.Path != "/full/data.pkg" {
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "packagesite.txz"), nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		url   string
+		found string
+		ok    bool
+	}{
+		{srv.URL + "/full", "packagesite.pkg, data.pkg", true},
+		{srv.URL + "/empty", "no packagesite.pkg or packagesite.txz", false},
+		{"file://" + dir, "packagesite.txz", true},
+		{"ftp://ftp.example.org/pub", "not checked", true},
+	}
+	for _, tt := range tests {
+		if found, ok := checkCatalog(context.Background(), tt.url); found != tt.found || ok != tt.ok {
+			t.Errorf("checkCatalog(%q) = %q, %v; want %q, %v", tt.url, found, ok, tt.found, tt.ok)
+		}
+	}
+}
+
+func TestAnonymizeTarget(t *testing.T) {
+	defer func(j string) { jailName = j }(jailName)
+	jailName = "web"
+	cfg := Config{Remote: "root@build01.example.net:2222"}
+	events := []Event{
+		{
+			Stage:   StageDetectEnv,
+			Status:  StatusOK,
+			Detail:  "Target: " + targetDescription(cfg) + "\nOS: FreeBSD 14.1",
+			Data:    map[string]any{"target": targetDescription(cfg)},
+			Message: "Environment detected",
+		},
+		{
+			Stage:   StageComplete,
+			Status:  StatusError,
+			Message: "remote build01.example.net:2222: ssh: handshake failed",
+			Detail:  "pkg -j web update failed; see webserver logs",
+		},
+	}
+	data, err := json.Marshal(newAnonymizer(cfg, events).events(events))
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := string(data)
+	for _, leak := range []string{"build01", "jail web", "-j web "} {
+		if strings.Contains(out, leak) {
+			t.Errorf("report still contains %q: %s", leak, out)
+		}
+	}
+	if !strings.Contains(out, "webserver") {
+		t.Errorf("jail name replaced inside another word: %s", out)
+	}
+}
+
+func TestDetectOSUnderRootDir(t *testing.T) {
+	defer func(r, db, keys, rel, ver string, confs []string) {
+		rootDir, pkgDBDir, pkgKeysDir, osReleasePath, freebsdVersion = r, db, keys, rel, ver
+		ghostbsdRepoConfs = confs
+	}(rootDir, pkgDBDir, pkgKeysDir, osReleasePath, freebsdVersion, slices.Clone(ghostbsdRepoConfs))
+
+	root := t.TempDir()
+	for _, dir := range []string{"etc/pkg", "bin"} {
+		if err := os.MkdirAll(filepath.Join(root, dir), 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(root, "bin/freebsd-version"), []byte("#!/bin/sh\necho 14.1-RELEASE-p5\n"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "etc/pkg/GhostBSD.conf"), nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	useRootDir(root)
+
+	info := detectOS(context.Background())
+	want := osInfo{Name: "FreeBSD", Version: "14.1-RELEASE-p5", GhostBSDRepos: filepath.Join(root, "etc/pkg/GhostBSD.conf")}
+	if info != want {
+		t.Errorf("detectOS() = %+v, want %+v", info, want)
+	}
+}
+
+func TestEventsCountOneAttempt(t *testing.T) {
+	m := initialModel(Config{Plain: true})
+	m.stOrder = []Stage{StagePkgUpdate}
+	m.stageCtx()
+	m, _ = m.skip()
+	if got := m.events[0].Attempts; got != 1 {
+		t.Errorf("skipped stage attempts = %d, want 1", got)
+	}
+	// Re-running it with r counts the skip as the first attempt.
+	m.retrying = true
+	m.settle(Event{Stage: StagePkgUpdate, Status: StatusOK, Attempts: 1})
+	if got := m.events[0].Attempts; got != 2 {
+		t.Errorf("re-run attempts = %d, want 2", got)
+	}
+	m, _ = m.abort()
+	if got := m.events[len(m.events)-1].Attempts; got != 1 {
+		t.Errorf("abort event attempts = %d, want 1", got)
+	}
+}
+
+func TestSlowMirrorLineKeepsProbeInfo(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(20 * time.Millisecond)
+		io.WriteString(w, "version = 2;\n")
+	}))
+	defer srv.Close()
+	conf := filepath.Join(t.TempDir(), "Slow.conf")
+	if err := os.WriteFile(conf, []byte("Slow: {\n  url: \""+srv.URL+"/repo\"\n}\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	r := checkRepoNetwork(context.Background(), Config{RepoConf: conf, SlowMirror: time.Millisecond})
+	if len(r.Lines) != 1 || !strings.Contains(r.Lines[0], "(ok, HTTP/1.1") || !strings.Contains(r.Lines[0], "reachable but slow") {
+		t.Errorf("lines = %q, want the probe info and the slow warning", r.Lines)
+	}
+}
+
+func TestDisallowedPaths(t *testing.T) {
+	base := filepath.Join(t.TempDir(), "db")
+	if err := os.MkdirAll(filepath.Join(base, "repo-dir.sqlite"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"repo-FreeBSD.sqlite", "repo-FreeBSD.sqlite-journal", "repo-FreeBSD.meta", "local.sqlite"} {
+		if err := os.WriteFile(filepath.Join(base, name), nil, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(filepath.Dir(base), "repo-outside.sqlite"), nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join(base, "local.sqlite"), filepath.Join(base, "repo-link.sqlite")); err != nil {
+		t.Fatal(err)
+	}
+	if err := syscall.Mkfifo(filepath.Join(base, "repo-fifo.sqlite"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		path    string
+		refused bool
+	}{
+		{"catalog", filepath.Join(base, "repo-FreeBSD.sqlite"), false},
+		{"catalog journal", filepath.Join(base, "repo-FreeBSD.sqlite-journal"), false},
+		{"catalog meta", filepath.Join(base, "repo-FreeBSD.meta"), false},
+		{"local.sqlite", filepath.Join(base, "local.sqlite"), true},
+		{"../ escape", base + "/../repo-outside.sqlite", true},
+		{"../ back in", base + "/../db/repo-FreeBSD.sqlite", false},
+		{"nested", filepath.Join(base, "repo-dir.sqlite", "repo-x.sqlite"), true},
+		{"subdirectory match", filepath.Join(base, "repo-dir.sqlite"), true},
+		{"symlink", filepath.Join(base, "repo-link.sqlite"), true},
+		{"fifo", filepath.Join(base, "repo-fifo.sqlite"), true},
+		{"missing", filepath.Join(base, "repo-gone.sqlite"), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := disallowedPaths(context.Background(), base, []string{tt.path})
+			if refused := len(got) > 0; refused != tt.refused {
+				t.Errorf("disallowedPaths(%q) = %q, want refused %v", tt.path, got, tt.refused)
+			}
+		})
+	}
+}